@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/postgres"
+	"go.uber.org/zap"
+	"os"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Create the Postgres jobs table",
+	Long: `Creates (or updates) the table, index and trigger the Postgres event
+source needs, in the database at LAMBDO_POSTGRES_URL. It's safe to run on every deploy.`,
+	Run: RunMigrateCommand,
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+}
+
+func RunMigrateCommand(cmd *cobra.Command, args []string) {
+	if len(config.GetConfig().PostgresUrl) == 0 {
+		logging.GetLogger().Error("LAMBDO_POSTGRES_URL must be set to migrate")
+		os.Exit(1)
+	}
+
+	if err := postgres.Migrate(cmd.Context()); err != nil {
+		logging.GetLogger().Error("migration error", zap.Error(err))
+		os.Exit(1)
+	}
+
+	logging.GetLogger().Info("postgres jobs table is ready", zap.String("table", config.GetConfig().PostgresTable))
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/superfly/lambdo/internal/amqp"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/kafka"
+	"github.com/superfly/lambdo/internal/nats"
+	"github.com/superfly/lambdo/internal/postgres"
+	"github.com/superfly/lambdo/internal/redis"
+	"github.com/superfly/lambdo/internal/schedule"
+	"github.com/superfly/lambdo/internal/source"
+	"github.com/superfly/lambdo/internal/sqs"
+	"github.com/superfly/lambdo/internal/webhook"
+	"sync"
+)
+
+// eventSources returns every configured event source, starting
+// any that must be started (e.g. to accept HTTP requests)
+func eventSources(ctx context.Context) ([]source.EventSource, error) {
+	sources := []source.EventSource{}
+
+	if len(config.GetConfig().SQSQueueUrl) > 0 {
+		sources = append(sources, sqs.NewSource())
+	}
+
+	if len(config.GetConfig().WebhookAddr) > 0 {
+		wh := webhook.NewSource()
+		if err := wh.Start(ctx); err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, wh)
+	}
+
+	if len(config.GetConfig().RedisUrl) > 0 {
+		rs, err := redis.NewSource()
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, rs)
+	}
+
+	if len(config.GetConfig().NatsUrl) > 0 {
+		ns, err := nats.NewSource()
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, ns)
+	}
+
+	if len(config.GetConfig().PostgresUrl) > 0 {
+		ps, err := postgres.NewSource(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, ps)
+	}
+
+	if len(config.GetConfig().AMQPUrl) > 0 {
+		as, err := amqp.NewSource()
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, as)
+	}
+
+	if len(config.GetConfig().KafkaBrokers) > 0 {
+		ks, err := kafka.NewSource()
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, ks)
+	}
+
+	if len(config.GetConfig().Schedules) > 0 {
+		sch, err := schedule.NewSource()
+		if err != nil {
+			return nil, err
+		}
+
+		sch.Start(ctx)
+		sources = append(sources, sch)
+	}
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no event sources are configured, set LAMBDO_SQS_QUEUE_URL, LAMBDO_WEBHOOK_ADDR, LAMBDO_REDIS_URL, LAMBDO_NATS_URL, LAMBDO_POSTGRES_URL, LAMBDO_AMQP_URL, LAMBDO_KAFKA_BROKERS or LAMBDO_SCHEDULES")
+	}
+
+	return sources, nil
+}
+
+// listen receives events from every source until the context is
+// cancelled. If any source fails, its error is returned once
+// every source has stopped.
+func listen(ctx context.Context, sources []source.EventSource, batches chan *source.Batch) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(sources))
+
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src source.EventSource) {
+			defer wg.Done()
+
+			if err := source.Listen(ctx, src, batches); err != nil {
+				errs <- err
+
+				// One broken source stops them all
+				cancel()
+			}
+		}(src)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
@@ -0,0 +1,161 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"github.com/superfly/lambdo/internal/broker"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/fly"
+	"github.com/superfly/lambdo/internal/jobs"
+	"github.com/superfly/lambdo/internal/source"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How many jobs are listed by default, and at most
+const (
+	defaultJobsLimit = 50
+	maxJobsLimit     = 500
+)
+
+// How long a source gets to report its health
+const healthTimeout = 5 * time.Second
+
+type jobResponse struct {
+	*jobs.Job
+
+	// Machine is the job's Machine as it is right
+	// now, if it has one and it still exists
+	Machine      *fly.Machine `json:"machine,omitempty"`
+	MachineError string       `json:"machine_error,omitempty"`
+}
+
+type sourceHealth struct {
+	Name    string            `json:"name"`
+	Healthy bool              `json:"healthy"`
+	Details map[string]string `json:"details,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// listJobs lists the most recent jobs, e.g. GET /jobs?limit=10
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	limit := defaultJobsLimit
+	if l := r.URL.Query().Get("limit"); len(l) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+	}
+
+	list, err := jobs.GetStore().List(min(limit, maxJobsLimit))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"jobs": list})
+}
+
+// getJob returns a job along with the current
+// state of its Machine, e.g. GET /jobs/job_123
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if len(id) == 0 || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	job, err := jobs.GetStore().Get(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	response := &jobResponse{Job: job}
+	if len(job.MachineId) > 0 {
+		api := fly.NewApi(config.GetConfig().FlyToken, config.GetConfig().FlyApiUrl)
+		machine, machineErr := api.GetMachine(r.Context(), &fly.GetMachineInput{
+			AppName:   config.GetConfig().FlyApp,
+			MachineId: job.MachineId,
+		})
+
+		if machineErr != nil {
+			response.MachineError = machineErr.Error()
+		} else {
+			response.Machine = machine
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// inFlight returns how many groups of events (and events)
+// are being handled right now, per image
+func (s *Server) inFlight(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"images": broker.InFlightByImage()})
+}
+
+// health reports on every event source, and responds
+// with a 503 if any of them is unhealthy
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	status := http.StatusOK
+	sources := []*sourceHealth{}
+
+	for _, src := range s.Sources {
+		h := &sourceHealth{
+			Name:    src.Name(),
+			Healthy: true,
+		}
+
+		// Sources that can't tell us otherwise are assumed healthy
+		if checker, ok := src.(source.HealthChecker); ok {
+			ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+			details, err := checker.Health(ctx)
+			cancel()
+
+			h.Details = details
+			if err != nil {
+				h.Healthy = false
+				h.Error = err.Error()
+				status = http.StatusServiceUnavailable
+			}
+		}
+
+		sources = append(sources, h)
+	}
+
+	writeJSON(w, status, map[string]any{
+		"healthy": status == http.StatusOK,
+		"sources": sources,
+	})
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, jobs.ErrDisabled):
+		writeError(w, http.StatusNotFound, "job store is disabled, set LAMBDO_JOBS_DB_PATH")
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,123 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/metrics"
+	"github.com/superfly/lambdo/internal/source"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Server is an HTTP API to ask a running lambdo
+// instance about its jobs and event sources
+type Server struct {
+	Addr  string
+	Token string
+
+	// Sources are checked by the health endpoint
+	Sources []source.EventSource
+
+	mux *http.ServeMux
+}
+
+// NewServer returns an admin Server for the configured
+// address and token, reporting on the given sources
+func NewServer(sources []source.EventSource) *Server {
+	s := &Server{
+		Addr:    config.GetConfig().AdminAddr,
+		Token:   config.GetConfig().AdminToken,
+		Sources: sources,
+		mux:     http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/jobs", s.listJobs)
+	s.mux.HandleFunc("/jobs/", s.getJob)
+	s.mux.HandleFunc("/inflight", s.inFlight)
+	s.mux.HandleFunc("/health", s.health)
+	s.mux.Handle("/metrics", metrics.Handler())
+
+	return s
+}
+
+// Start listens on the server's address and serves requests in the
+// background until the context is cancelled. Not being able to
+// listen is returned as an error.
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on admin address: %w", err)
+	}
+
+	srv := &http.Server{
+		Handler:           s.authenticate(s.mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		logging.GetLogger().Info("Shutdown: stopping admin server")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		logging.GetLogger().Info("admin server listening", zap.String("addr", listener.Addr().String()))
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.GetLogger().Error("admin server error", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+// authenticate requires the admin token as a bearer
+// token on every request, if a token is set
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.Token) > 0 {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.GetLogger().Error("could not write admin response", zap.Error(err))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// allowGet responds with an error to anything but GET
+// requests, and returns whether the request was allowed
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+
+	return true
+}
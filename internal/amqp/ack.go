@@ -0,0 +1,120 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/superfly/lambdo/internal/source"
+	"strings"
+	"time"
+)
+
+// Ack acknowledges the given messages, which removes them from the queue
+func (s *Source) Ack(ctx context.Context, events []*source.Event) error {
+	return each(events, func(d amqp.Delivery) error {
+		return d.Ack(false)
+	})
+}
+
+// Nack sends the given messages to the retry queue, from which they're
+// redelivered after RetryDelay, and acks them once the server confirms
+// it has them. Without a retry delay, the server requeues them instead.
+func (s *Source) Nack(ctx context.Context, events []*source.Event) error {
+	if s.RetryDelay <= 0 {
+		return each(events, func(d amqp.Delivery) error {
+			return d.Nack(false, true)
+		})
+	}
+
+	for _, e := range events {
+		if err := s.retry(ctx, e); err != nil {
+			return fmt.Errorf("could not retry message %s: %w", e.Id, err)
+		}
+	}
+
+	return nil
+}
+
+// retry publishes the event's message to the retry queue, on the
+// channel it came from, so it's only acked if that's still open
+func (s *Source) retry(ctx context.Context, e *source.Event) error {
+	d, ok := e.Handle.(amqp.Delivery)
+	if !ok {
+		return fmt.Errorf("event is not an amqp delivery")
+	}
+
+	ch, ok := d.Acknowledger.(*amqp.Channel)
+	if !ok {
+		return fmt.Errorf("delivery has no channel")
+	}
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, "", s.retryQueue(), false, false, retryPublishing(d, e.ReceiveCount))
+	if err != nil {
+		return err
+	}
+
+	// Unconfirmed messages are redelivered once our channel closes
+	confirmed, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !confirmed {
+		return fmt.Errorf("the retry queue did not take the message")
+	}
+
+	return d.Ack(false)
+}
+
+// retryPublishing copies a message for the retry queue. The server's
+// own headers are left out, and how many times the message was received
+// is kept in a header of ours, as the copy starts counting anew.
+func retryPublishing(d amqp.Delivery, receiveCount int) amqp.Publishing {
+	headers := amqp.Table{}
+	for name, value := range d.Headers {
+		if !strings.HasPrefix(strings.ToLower(name), "x-") {
+			headers[name] = value
+		}
+	}
+	headers[receiveCountHeader] = int64(receiveCount)
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+// Extend does nothing, unacked messages stay with us until we
+// ack or nack them, or our channel closes (or the server's consumer
+// timeout, 30 minutes by default for RabbitMQ, runs out). Events that
+// fail are nacked, only events whose Machine couldn't be waited on
+// are left unacked until then.
+func (s *Source) Extend(ctx context.Context, events []*source.Event, d time.Duration) error {
+	return nil
+}
+
+// each calls fn for the delivery of every event. Deliveries can only be
+// acked on the channel they came from, so this fails if it was closed.
+func each(events []*source.Event, fn func(d amqp.Delivery) error) error {
+	for _, e := range events {
+		d, ok := e.Handle.(amqp.Delivery)
+		if !ok {
+			return fmt.Errorf("event %s is not an amqp delivery", e.Id)
+		}
+
+		if err := fn(d); err != nil {
+			return fmt.Errorf("could not reply to message %s: %w", e.Id, err)
+		}
+	}
+
+	return nil
+}
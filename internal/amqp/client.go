@@ -0,0 +1,238 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/dlq"
+	"github.com/superfly/lambdo/internal/logging"
+	"go.uber.org/zap"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long to wait between attempts to reconnect, at most
+const maxReconnectDelay = 30 * time.Second
+
+// Types of RabbitMQ queues, which count deliveries differently
+const (
+	QueueTypeQuorum  = "quorum"
+	QueueTypeClassic = "classic"
+)
+
+// Source is an EventSource backed by an AMQP 0-9-1 (e.g. RabbitMQ)
+// queue. Each message is an event: its body is the event body,
+// and its headers are the event attributes.
+type Source struct {
+	Queue string
+
+	// QueueType is how the queue counts deliveries: quorum queues
+	// count them, classic queues only flag redelivered messages
+	QueueType string
+
+	// Prefetch is how many messages may be unacked
+	// (received, but not yet handled) at once
+	Prefetch int
+
+	// RetryDelay is how long failed messages wait in the retry
+	// queue before they're redelivered. Without one, they are
+	// requeued (at the head of the queue) right away.
+	RetryDelay time.Duration
+
+	url string
+
+	// Guards the connection, which is set up again if it closes
+	mu         sync.Mutex
+	conn       *amqp.Connection
+	deliveries <-chan amqp.Delivery
+}
+
+// NewSource connects to the AMQP server, and returns an
+// EventSource consuming from the configured queue
+func NewSource() (*Source, error) {
+	prefetch := config.GetConfig().AMQPPrefetch
+	if prefetch < 1 {
+		prefetch = config.GetConfig().EventsPerMachine
+	}
+
+	queueType := config.GetConfig().AMQPQueueType
+	if queueType != QueueTypeQuorum && queueType != QueueTypeClassic {
+		return nil, fmt.Errorf("config amqp_queue_type must be %s or %s", QueueTypeQuorum, QueueTypeClassic)
+	}
+
+	retryDelay := time.Duration(config.GetConfig().AMQPRetryDelaySeconds) * time.Second
+
+	// Requeued messages of a classic queue are never seen as delivered more
+	// than twice, so they'd never be dead-lettered and would be retried forever.
+	// Messages sent through the retry queue carry their count along.
+	maxReceives := config.GetConfig().MaxReceiveCount
+	if queueType == QueueTypeClassic && retryDelay == 0 && dlq.GetQueue() != nil && maxReceives > 2 {
+		return nil, fmt.Errorf("config max_receive_count is %d, but classic queues can only tell if a message was delivered more than once, use a quorum queue, a retry delay, or set it to 2 at most", maxReceives)
+	}
+
+	s := &Source{
+		Queue:      config.GetConfig().AMQPQueue,
+		QueueType:  queueType,
+		Prefetch:   prefetch,
+		RetryDelay: retryDelay,
+		url:        config.GetConfig().AMQPUrl,
+	}
+
+	// We fail early if we can't connect at all, later
+	// on we keep trying to reconnect instead
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Source) Name() string {
+	return "amqp"
+}
+
+// Health checks the queue exists, and returns how
+// many messages are ready and how many consumers it has
+func (s *Source) Health(ctx context.Context) (map[string]string, error) {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil, fmt.Errorf("not connected to amqp")
+	}
+
+	// A failed passive declare closes the channel,
+	// so this uses one of its own
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("could not open channel: %w", err)
+	}
+	defer ch.Close()
+
+	q, err := ch.QueueDeclarePassive(s.Queue, true, false, false, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not inspect queue: %w", err)
+	}
+
+	return map[string]string{
+		"queue":     s.Queue,
+		"ready":     strconv.Itoa(q.Messages),
+		"consumers": strconv.Itoa(q.Consumers),
+	}, nil
+}
+
+// connect opens a connection and a channel, and starts consuming the
+// queue. Messages are acked manually, and at most Prefetch are unacked.
+// With a retry delay, the retry queue is declared too, and the channel
+// confirms what's published to it.
+func (s *Source) connect() error {
+	conn, err := amqp.DialConfig(s.url, amqp.Config{
+		Heartbeat:  10 * time.Second,
+		Properties: amqp.Table{"connection_name": "lambdo"},
+	})
+	if err != nil {
+		return fmt.Errorf("could not connect to amqp: %w", err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("could not open channel: %w", err)
+	}
+
+	if err := ch.Qos(s.Prefetch, 0, false); err != nil {
+		conn.Close()
+		return fmt.Errorf("could not set prefetch: %w", err)
+	}
+
+	if s.RetryDelay > 0 {
+		if err := s.declareRetryQueue(ch); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	deliveries, err := ch.Consume(s.Queue, "", false, false, false, false, nil)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("could not consume queue %s: %w", s.Queue, err)
+	}
+
+	// The deliveries channel is closed along with the channel,
+	// which is when Receive reconnects. This tells us why.
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		if err, ok := <-closed; ok {
+			logging.GetLogger().Warn("amqp channel closed", zap.String("queue", s.Queue), zap.Error(err))
+		}
+	}()
+
+	s.mu.Lock()
+	s.conn = conn
+	s.deliveries = deliveries
+	s.mu.Unlock()
+
+	return nil
+}
+
+// retryQueue is where failed messages wait out the retry delay
+func (s *Source) retryQueue() string {
+	return s.Queue + ".retry"
+}
+
+// declareRetryQueue creates the retry queue, if it doesn't exist yet.
+// Its messages expire after RetryDelay, and are then dead-lettered
+// (through the default exchange) back onto the queue we consume.
+func (s *Source) declareRetryQueue(ch *amqp.Channel) error {
+	_, err := ch.QueueDeclare(s.retryQueue(), true, false, false, false, amqp.Table{
+		"x-message-ttl":             s.RetryDelay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": s.Queue,
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not declare retry queue %s (delete it if its retry delay changed): %w", s.retryQueue(), err)
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("could not put channel in confirm mode: %w", err)
+	}
+
+	return nil
+}
+
+// reconnect closes what's left of the connection, and connects again
+// until it works (or the context is cancelled), backing off as it goes.
+// Unacked messages are redelivered by the server once the old
+// connection is closed.
+func (s *Source) reconnect(ctx context.Context) error {
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = nil
+	s.deliveries = nil
+	s.mu.Unlock()
+
+	delay := time.Second
+	for {
+		err := s.connect()
+		if err == nil {
+			logging.GetLogger().Info("reconnected to amqp", zap.String("queue", s.Queue))
+			return nil
+		}
+
+		logging.GetLogger().Warn("could not reconnect to amqp, retrying", zap.Error(err), zap.Duration("delay", delay))
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
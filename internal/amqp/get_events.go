@@ -0,0 +1,168 @@
+package amqp
+
+import (
+	"context"
+	"encoding/json"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/source"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// headerPrefix is optional on headers, e.g. "Lambdo-Image"
+// and "image" are both the "image" attribute
+const headerPrefix = "lambdo-"
+
+// deliveryCountHeader is set by quorum queues on redelivered
+// messages, and counts how many times they were delivered before
+const deliveryCountHeader = "x-delivery-count"
+
+// receiveCountHeader is set by lambdo on messages it sends through the
+// retry queue, and counts how many times they were received before
+const receiveCountHeader = "x-lambdo-receive-count"
+
+// Receive waits for a message, and returns it along with any others
+// that are already here, up to EventsPerMachine. If the channel was
+// closed, it reconnects and returns no events.
+func (s *Source) Receive(ctx context.Context) ([]*source.Event, error) {
+	s.mu.Lock()
+	deliveries := s.deliveries
+	s.mu.Unlock()
+
+	if deliveries == nil {
+		return nil, s.reconnect(ctx)
+	}
+
+	wait := time.Duration(config.GetConfig().PollSeconds) * time.Second
+	if wait < time.Second {
+		wait = time.Second
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	logging.GetLogger().Debug("waiting for amqp messages", zap.String("queue", s.Queue))
+
+	events := []*source.Event{}
+	select {
+	case d, ok := <-deliveries:
+		if !ok {
+			return nil, s.reconnect(ctx)
+		}
+
+		events = append(events, s.toEvent(d))
+	case <-timer.C:
+		return events, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// Take whatever else is already here, without waiting for it
+	for len(events) < config.GetConfig().EventsPerMachine {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				// What we have can't be acked anymore, and
+				// will be redelivered, so we drop it
+				return nil, s.reconnect(ctx)
+			}
+
+			events = append(events, s.toEvent(d))
+		default:
+			return events, nil
+		}
+	}
+
+	return events, nil
+}
+
+func (s *Source) toEvent(d amqp.Delivery) *source.Event {
+	id := d.MessageId
+	if len(id) == 0 {
+		id = strconv.FormatUint(d.DeliveryTag, 10)
+	}
+
+	// Classic queues only tell us whether a message was delivered before
+	receiveCount := 1
+	if d.Redelivered {
+		receiveCount = 2
+	}
+
+	counted := false
+	retried := 0
+	attributes := map[string]string{}
+	for name, value := range d.Headers {
+		if strings.EqualFold(name, deliveryCountHeader) {
+			if count, ok := deliveryCount(value); ok {
+				receiveCount = count + 1
+				counted = true
+			}
+			continue
+		}
+
+		if strings.EqualFold(name, receiveCountHeader) {
+			if count, ok := deliveryCount(value); ok {
+				retried = count
+			}
+			continue
+		}
+
+		// Headers the server sets (e.g. x-death, once a
+		// message went through the retry queue) aren't ours
+		if strings.HasPrefix(strings.ToLower(name), "x-") {
+			continue
+		}
+
+		attr := strings.TrimPrefix(strings.ToLower(name), headerPrefix)
+		attributes[strings.ReplaceAll(attr, "-", "_")] = headerValue(value)
+	}
+
+	if d.Redelivered && !counted && s.QueueType == QueueTypeQuorum {
+		logging.GetLogger().Warn("a redelivered message has no delivery count, set LAMBDO_AMQP_QUEUE_TYPE=classic if the queue is not a quorum queue", zap.String("queue", s.Queue))
+	}
+
+	return &source.Event{
+		Id:           id,
+		Body:         string(d.Body),
+		Attributes:   attributes,
+		ReceiveCount: retried + receiveCount,
+		Handle:       d,
+	}
+}
+
+// deliveryCount reads the delivery count header,
+// which may be any size of integer
+func deliveryCount(value any) (int, bool) {
+	switch v := value.(type) {
+	case int64:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int16:
+		return int(v), true
+	}
+
+	return 0, false
+}
+
+// headerValue turns a header value into an attribute. Values that
+// aren't strings are kept as JSON, e.g. a command can be an array.
+func headerValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+
+	return string(encoded)
+}
@@ -1,53 +1,119 @@
 package broker
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/superfly/lambdo/internal/config"
 	"github.com/superfly/lambdo/internal/fly"
+	"github.com/superfly/lambdo/internal/jobs"
 	"github.com/superfly/lambdo/internal/logging"
-	events "github.com/superfly/lambdo/internal/sqs"
+	"github.com/superfly/lambdo/internal/metrics"
+	"github.com/superfly/lambdo/internal/source"
+	"github.com/superfly/lambdo/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+	"net/http"
+	"strconv"
+	"time"
 )
 
 type Event struct {
-	Image string
-	Size  string
-	Body  string
-	Cmd   []string
-	Meta  map[string]string
+	Image  string
+	Size   string
+	Guest  *fly.MachineSize
+	Body   string
+	Cmd    []string
+	Region string
+
+	// Source is the original event, used
+	// to ack it once it's been handled
+	Source *source.Event
 }
 
+// EventCollection is a group of events that
+// can all be handled by the same Machine
 type EventCollection struct {
+	// Key identifies the image, size, command and
+	// region shared by every event in the collection
+	Key   string
+	JobId string
+
+	// MachineName, if set, is the name of the Machine to create,
+	// which fails if a Machine by that name already exists
+	MachineName string
+
+	Image  string
+	Size   string
+	Guest  *fly.MachineSize
+	Cmd    []string
+	Region string
 	Events []*Event
+
+	// Source is where the events came from
+	Source source.EventSource
+
+	stopHeartbeat func()
+	dispatchedAt  time.Time
+
+	// spanContext is the span the collection was grouped in
+	spanContext trace.SpanContext
 }
 
-func SendToMachine(messages []types.Message) error {
-	api := fly.NewApi(config.GetConfig().FlyToken)
-	appName := config.GetConfig().FlyApp
-	// Each attempt iteration will try a new region
-	// TODO: Respect config.GetConfig().FlyRegion setting
-	regions := []string{"bos", "dfw", "den", "mia"}
+// SourceEvents returns the original events
+// of every event in the collection
+func (c *EventCollection) SourceEvents() []*source.Event {
+	events := make([]*source.Event, 0, len(c.Events))
+	for _, e := range c.Events {
+		events = append(events, e.Source)
+	}
+
+	return events
+}
+
+// GroupEvents groups a batch of events by which image, size (or guest),
+// command and region they require, so each group can be handled by one Machine. Each
+// group keeps its events' leases extended until it is sent to a Machine.
+func GroupEvents(ctx context.Context, batch *source.Batch) []*EventCollection {
+	groupCtx, span := tracing.Start(
+		trace.ContextWithSpanContext(ctx, batch.SpanContext),
+		"broker.GroupEvents",
+		trace.WithAttributes(attribute.Int("lambdo.events", len(batch.Events))),
+	)
+	defer span.End()
 
 	eventsPerMachine := map[string]*EventCollection{}
+	collections := []*EventCollection{}
 
-	// Group messages (events) by which image, size, and command they require
-	for _, m := range messages {
+	for _, m := range batch.Events {
 		image, imageErr := findAttribute("image", m)
 		if imageErr != nil {
 			logging.GetLogger().Warn("an event had no image", zap.String("error", imageErr.Error()))
+			retryOrDeadLetter(groupCtx, batch.Source, []*source.Event{m}, "event had no image")
+			continue
+		}
+
+		// A custom guest size wins over a size preset
+		guest, guestErr := findGuest(m)
+		if guestErr != nil {
+			logging.GetLogger().Warn("an event had an invalid guest size, no machine will be created", zap.String("error", guestErr.Error()))
+			retryOrDeadLetter(groupCtx, batch.Source, []*source.Event{m}, fmt.Sprintf("invalid guest size: %v", guestErr))
 			continue
 		}
 
 		size, sizeErr := findAttribute("size", m)
 
-		if sizeErr != nil {
-			logging.GetLogger().Warn("an event had no size, defaulting to performance-2x", zap.String("error", sizeErr.Error()))
-			size = "performance-2x"
+		if guest != nil {
+			size = ""
+		} else if sizeErr != nil {
+			logging.GetLogger().Warn("an event had no size, defaulting to "+defaultSize, zap.String("error", sizeErr.Error()))
+			size = defaultSize
 		}
 
 		var cmd []string
@@ -60,134 +126,389 @@ func SendToMachine(messages []types.Message) error {
 		if len(cmdString) > 0 {
 			if jErr := json.Unmarshal([]byte(cmdString), &cmd); jErr != nil {
 				logging.GetLogger().Warn("could not parse command, no machine will be created", zap.String("error", jErr.Error()))
+				retryOrDeadLetter(groupCtx, batch.Source, []*source.Event{m}, "could not parse command")
 				continue
 			}
 		}
 
+		// An empty region means "use the configured regions"
+		region, _ := findAttribute("region", m)
+
+		// Events can be given a job ID up front, to find them by later.
+		// Events with different job IDs never share a Machine.
+		jobId, _ := findAttribute("job_id", m)
+
+		// Only one Machine can have a given name, which keeps
+		// events from being handled twice (e.g. scheduled runs)
+		machineName, _ := findAttribute("machine_name", m)
+
 		// md5 of attributes that affect machine creation, so we can group like-events
 		// into machines that run the same way
-		eventsPerMachineKeyHash := md5.Sum([]byte(fmt.Sprintf("%s-%s-%s", image, size, cmdString)))
+		eventsPerMachineKeyHash := md5.Sum([]byte(fmt.Sprintf("%s-%s-%s-%s-%s", image, size, guestKey(guest), cmdString, region)))
 		eventsPerMachineKey := hex.EncodeToString(eventsPerMachineKeyHash[:])
-		if _, ok := eventsPerMachine[eventsPerMachineKey]; !ok {
-			eventsPerMachine[eventsPerMachineKey] = &EventCollection{}
+		collectionKey := eventsPerMachineKey + "-" + jobId + "-" + machineName
+		if _, ok := eventsPerMachine[collectionKey]; !ok {
+			eventsPerMachine[collectionKey] = &EventCollection{
+				Key:         eventsPerMachineKey,
+				JobId:       jobId,
+				MachineName: machineName,
+				Image:       image,
+				Size:        size,
+				Guest:       guest,
+				Cmd:         cmd,
+				Region:      region,
+				Source:      batch.Source,
+			}
+			collections = append(collections, eventsPerMachine[collectionKey])
 		}
 
-		eventsPerMachine[eventsPerMachineKey].Events = append(eventsPerMachine[eventsPerMachineKey].Events, &Event{
-			Image: image,
-			Body:  *m.Body,
-			Size:  size,
-			Cmd:   cmd,
-			Meta:  map[string]string{"receipt": *m.ReceiptHandle},
+		eventsPerMachine[collectionKey].Events = append(eventsPerMachine[collectionKey].Events, &Event{
+			Image:  image,
+			Body:   m.Body,
+			Size:   size,
+			Guest:  guest,
+			Cmd:    cmd,
+			Region: region,
+			Source: m,
 		})
 	}
 
-	// Build JSON array of events, for each unique image
+	// Keep the events from being redelivered while they wait
+	// for a worker, and while we're still working on them
+	for _, collection := range collections {
+		if len(collection.JobId) == 0 {
+			collection.JobId = jobs.IdFor(collection.messageIds())
+		}
+		collection.spanContext = span.SpanContext()
+
+		collection.stopHeartbeat = source.Heartbeat(
+			ctx,
+			collection.Source,
+			collection.SourceEvents(),
+			time.Duration(config.GetConfig().HeartbeatSeconds)*time.Second,
+			time.Duration(config.GetConfig().LeaseSeconds)*time.Second,
+		)
+	}
+
+	span.SetAttributes(attribute.Int("lambdo.collections", len(collections)))
+
+	return collections
+}
+
+// assignedJobIds returns the job IDs handed out for the collection's
+// events when they were accepted, which the job can be found by
+func (c *EventCollection) assignedJobIds() []string {
+	ids := []string{}
+	for _, e := range c.Events {
+		if id, ok := e.Source.Attribute(jobs.AssignedIdAttribute); ok && len(id) > 0 {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+func (c *EventCollection) messageIds() []string {
+	ids := make([]string, 0, len(c.Events))
+	for _, e := range c.Events {
+		ids = append(ids, e.Source.Id)
+	}
+
+	return ids
+}
+
+// Release stops extending the leases of the collection's events
+func (c *EventCollection) Release() {
+	if c.stopHeartbeat != nil {
+		c.stopHeartbeat()
+	}
+}
+
+// SendToMachine creates a Machine to handle a collection of events,
+// and acks the events once the Machine has handled them
+func SendToMachine(ctx context.Context, collection *EventCollection) error {
+	defer collection.Release()
+	defer inFlight.add(collection)()
+
+	ctx, span := tracing.Start(
+		trace.ContextWithSpanContext(ctx, collection.spanContext),
+		"broker.SendToMachine",
+		trace.WithAttributes(
+			attribute.String("lambdo.job_id", collection.JobId),
+			attribute.String("lambdo.image", collection.Image),
+			attribute.Int("lambdo.events", len(collection.Events)),
+		),
+	)
+	defer span.End()
+
+	api := fly.NewApi(config.GetConfig().FlyToken, config.GetConfig().FlyApiUrl)
+	appName := config.GetConfig().FlyApp
+	src := collection.Source
+	handled := collection.SourceEvents()
+
+	// Build JSON array of events
 	// This assumes each event body is a
 	// valid JSON string (lol)
 	// This is dumb af, but good enough for now
-	for _, collection := range eventsPerMachine {
-		eventStrings := ""
-		receipts := []string{}
-		image := ""
-		size := ""
-		var cmd []string
-		for k, e := range collection.Events {
-			if k == 0 {
-				eventStrings += e.Body
-			} else {
-				eventStrings += "," + e.Body
-			}
-			receipts = append(receipts, e.Meta["receipt"])
-
-			// These get reset on every iteration, but in our scenario here,
-			// they'll always get set to the same values since we segregated
-			// them above. Just another code smell, no worries.
-			image = e.Image
-			size = e.Size
-			cmd = e.Cmd
-		}
-
-		eventStringJson := fmt.Sprintf("[%s]", eventStrings)
-		encodedJson := base64.StdEncoding.EncodeToString([]byte(eventStringJson))
-
-		logging.GetLogger().Debug("creating Machine", zap.String("app-name", appName), zap.String("image", image))
-
-		success := false
-
-		for k, region := range regions {
-			machine := fly.CreateMachineInput{
-				AppName: config.GetConfig().FlyApp,
-				Machine: fly.Machine{
-					Region: region,
-					Config: fly.MachineConfig{
-						Image: image,
-						Env: map[string]string{
-							"EVENTS_PATH": "/tmp/events.json",
-						},
-						/*
-							Guest: fly.MachineSize{
-								CpuCount: 2,
-								RAM:      2048,
-								Type:     "shared",
-							},
-						*/
-						Size: size,
-						Files: []fly.MachineFile{
-							{
-								GuestPath: "/tmp/events.json",
-								RawValue:  encodedJson,
-							},
-						},
-						AutoDestroy: true,
-					},
-				},
-			}
+	eventStrings := ""
+	for k, e := range collection.Events {
+		if k == 0 {
+			eventStrings += e.Body
+		} else {
+			eventStrings += "," + e.Body
+		}
+	}
 
-			if len(cmd) > 0 {
-				machine.Machine.Config.Processes = []fly.MachineProcess{
-					{
-						Cmd: cmd,
-					},
-				}
-			}
+	eventStringJson := fmt.Sprintf("[%s]", eventStrings)
+	encodedJson := base64.StdEncoding.EncodeToString([]byte(eventStringJson))
 
-			m, err := api.CreateMachine(&machine)
+	logging.GetLogger().Debug("creating Machine", zap.String("app-name", appName), zap.String("image", collection.Image), zap.String("job-id", collection.JobId))
+	beginJob(collection)
+	metrics.BatchesDispatched.WithLabelValues(src.Name()).Inc()
 
-			if err != nil {
-				logging.GetLogger().Error("could not create Machine", zap.Error(err), zap.Int("attempt", k), zap.String("region", region))
-				continue // try next region
-			}
+	// Holds the events in the queue until we're allowed to create another Machine
+	release, limitErr := machineLimiter.acquire(ctx, api, collection.Image)
+	if errors.Is(limitErr, context.Canceled) {
+		logging.GetLogger().Info("Shutdown: no longer waiting for a free machine slot")
+		finishJob(collection, jobs.StatusUnknown, "shut down before a Machine was created")
+		return nil
+	}
 
-			success = true
-			logging.GetLogger().Debug("created machine", zap.String("machine-id", m.Id))
-			break // Break out of region retry loop
-		}
+	if limitErr != nil {
+		finishJob(collection, jobs.StatusUnknown, fmt.Sprintf("could not wait for a free machine slot: %v", limitErr))
+		return fmt.Errorf("could not wait for a free machine slot: %w", limitErr)
+	}
+	defer release()
+
+	// Pooled Machines are re-used, so they must stick around after they stop.
+	// They also already have a name, so named Machines are always created.
+	pooled := warmMachines.enabled() && len(collection.MachineName) == 0
+	machineConfig := buildMachineConfig(collection, encodedJson, pooled)
+
+	// Lets the workload's own spans join this trace
+	if traceparent := tracing.Traceparent(ctx); len(traceparent) > 0 {
+		machineConfig.Env["TRACEPARENT"] = traceparent
+	}
+
+	launchedAt := time.Now()
+
+	var created *fly.Machine
+	var createErr error
+	if pooled {
+		created = warmMachines.launch(ctx, api, collection.Key, machineConfig)
+	}
 
-		if success == false {
-			logging.GetLogger().Error("could not create a Machine for this workload")
+	if created == nil {
+		created, createErr = createMachine(ctx, api, collection.Region, collection.MachineName, machineConfig)
+	}
+
+	// The Machine (if any) is listed by the API from here on
+	release()
+
+	// Someone else (e.g. another lambdo instance) is already handling these events
+	if created == nil && isDuplicate(collection, createErr) {
+		collection.Release()
+		logging.GetLogger().Info("a machine by this name already exists, acking events", zap.String("machine-name", collection.MachineName))
+		finishJob(collection, jobs.StatusDuplicate, fmt.Sprintf("machine %s already exists", collection.MachineName))
+
+		if ackErr := src.Ack(context.WithoutCancel(ctx), handled); ackErr != nil {
+			logging.GetLogger().Error("could not ack duplicate events", zap.Error(ackErr))
 		} else {
-			logging.GetLogger().Debug("machine created, deleting messages", zap.String("image", image))
-
-			// TODO: Handle if messages could not be deleted (so it does not get re-tried?) - perhaps retry logic?
-			for _, receipt := range receipts {
-				delErr := events.DeleteMessage(receipt)
-				if delErr != nil {
-					logging.GetLogger().Error("machine crated but could not delete message", zap.Error(delErr))
-				}
-			}
+			metrics.MessagesAcked.WithLabelValues(src.Name()).Add(float64(len(handled)))
 		}
+
+		return nil
 	}
 
 	// We don't return an error when a machine fails to be created
+	if created == nil {
+		collection.Release()
+		logging.GetLogger().Error("could not create a Machine for this workload", zap.Error(createErr))
+		reason := fmt.Sprintf("could not create a Machine: %v", createErr)
+		finishJob(collection, jobs.StatusFailed, reason)
+		retryOrDeadLetter(ctx, src, handled, reason)
+		return nil
+	}
+
+	startJob(collection.JobId, created)
+	span.SetAttributes(attribute.String("fly.machine_id", created.Id))
+
+	if config.GetConfig().WaitForMachine || pooled {
+		succeeded, waitErr := waitForMachine(ctx, api, created, launchedAt)
+		collection.Release()
+
+		if pooled {
+			if waitErr == nil {
+				warmMachines.recycle(ctx, api, collection.Key, created)
+			} else {
+				warmMachines.discard(ctx, api, created)
+			}
+		}
+
+		if waitErr != nil {
+			// We don't know if the workload succeeded, so we leave the events
+			// alone. They'll be redelivered if their lease runs out.
+			logging.GetLogger().Error("machine outcome unknown, leaving events in place", zap.Error(waitErr), zap.String("machine-id", created.Id))
+			finishJob(collection, jobs.StatusUnknown, fmt.Sprintf("could not wait for machine: %v", waitErr))
+			return nil
+		}
+
+		if !succeeded {
+			logging.GetLogger().Debug("machine did not succeed, nacking events", zap.String("image", collection.Image), zap.String("source", src.Name()))
+
+			reason := fmt.Sprintf("machine %s exited unsuccessfully", created.Id)
+			finishJob(collection, jobs.StatusFailed, reason)
+			retryOrDeadLetter(ctx, src, handled, reason)
+			return nil
+		}
+
+		finishJob(collection, jobs.StatusSucceeded, "")
+	} else {
+		// We're done with the job once the Machine is created
+		observeJob(collection, jobs.StatusStarted)
+	}
+
+	collection.Release()
+	logging.GetLogger().Debug("machine handled events, acking them", zap.String("image", collection.Image), zap.String("source", src.Name()))
+
+	// TODO: Handle if events could not be acked (so it does not get re-tried?) - perhaps retry logic?
+	ackCtx, ackSpan := tracing.Start(ctx, "source.Ack", trace.WithAttributes(attribute.String("lambdo.source", src.Name())))
+	ackErr := src.Ack(context.WithoutCancel(ackCtx), handled)
+	tracing.End(ackSpan, ackErr)
+
+	if ackErr != nil {
+		logging.GetLogger().Error("machine created but could not ack events", zap.Error(ackErr))
+	} else {
+		metrics.MessagesAcked.WithLabelValues(src.Name()).Add(float64(len(handled)))
+	}
+
 	return nil
 }
 
-func findAttribute(attr string, message types.Message) (string, error) {
-	for k, v := range message.MessageAttributes {
-		if k == attr {
-			return *v.StringValue, nil
+// buildMachineConfig returns the config of a Machine that
+// runs the collection's events, passed in as a JSON file
+func buildMachineConfig(collection *EventCollection, encodedJson string, pooled bool) fly.MachineConfig {
+	machineConfig := fly.MachineConfig{
+		Image: collection.Image,
+		Env: map[string]string{
+			"EVENTS_PATH":   "/tmp/events.json",
+			"LAMBDO_JOB_ID": collection.JobId,
+		},
+		Guest: collection.Guest,
+		Size:  collection.Size,
+		Files: []fly.MachineFile{
+			{
+				GuestPath: "/tmp/events.json",
+				RawValue:  encodedJson,
+			},
+		},
+		MetaData: map[string]string{
+			MetaManaged: "true",
+			MetaImage:   collection.Image,
+			MetaJob:     collection.JobId,
+		},
+		AutoDestroy: !pooled,
+	}
+
+	if pooled {
+		machineConfig.MetaData[MetaPool] = collection.Key
+	}
+
+	if len(collection.Cmd) > 0 {
+		machineConfig.Processes = []fly.MachineProcess{
+			{
+				Cmd: collection.Cmd,
+			},
 		}
 	}
 
+	return machineConfig
+}
+
+// createMachine creates a new Machine, trying each region in turn. If no
+// Machine could be created, the last error is returned. Errors that
+// won't go away by trying another region (e.g. a bad image) stop
+// us from trying the remaining regions.
+func createMachine(ctx context.Context, api *fly.Api, regionOverride, name string, machineConfig fly.MachineConfig) (*fly.Machine, error) {
+	var lastErr error
+
+	// Each attempt iteration will try a new region
+	for k, region := range regionsFor(regionOverride) {
+		machine := fly.CreateMachineInput{
+			AppName: config.GetConfig().FlyApp,
+			Machine: fly.Machine{
+				Name:   name,
+				Region: region,
+				Config: machineConfig,
+			},
+		}
+
+		started := time.Now()
+		attemptCtx, span := tracing.Start(ctx, "fly.CreateMachine", trace.WithAttributes(
+			attribute.String("fly.region", region),
+			attribute.Int("lambdo.attempt", k),
+		))
+		m, err := api.CreateMachine(attemptCtx, &machine)
+		tracing.End(span, err)
+		metrics.MachineCreateDuration.WithLabelValues(region).Observe(time.Since(started).Seconds())
+
+		if err != nil {
+			logging.GetLogger().Error("could not create Machine", zap.Error(err), zap.Int("attempt", k), zap.String("region", region))
+			lastErr = err
+
+			status := "error"
+			var apiErr *fly.APIError
+			if errors.As(err, &apiErr) {
+				status = strconv.Itoa(apiErr.StatusCode)
+			}
+			metrics.MachineCreateFailures.WithLabelValues(region, status).Inc()
+
+			if apiErr != nil && !apiErr.Retryable() {
+				logging.GetLogger().Warn("machine creation error is not retryable, not trying other regions", zap.Int("status", apiErr.StatusCode))
+				break
+			}
+
+			continue // try next region
+		}
+
+		logging.GetLogger().Debug("created machine", zap.String("machine-id", m.Id))
+		return m, nil
+	}
+
+	return nil, lastErr
+}
+
+// isDuplicate is true if the collection's Machine could not
+// be created because a Machine by its name already exists
+func isDuplicate(collection *EventCollection, err error) bool {
+	var apiErr *fly.APIError
+
+	return len(collection.MachineName) > 0 && errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict
+}
+
+func findAttribute(attr string, event *source.Event) (string, error) {
+	if v, ok := event.Attribute(attr); ok {
+		return v, nil
+	}
+
 	return "", fmt.Errorf("could not find an event %s", attr)
 }
+
+// regionsFor returns the ordered list of regions to try creating
+// a Machine in. An event's region overrides the configured
+// primary region, and the fallback regions are tried after.
+func regionsFor(override string) []string {
+	primary := config.GetConfig().FlyRegion
+	if len(override) > 0 {
+		primary = override
+	}
+
+	regions := []string{primary}
+	for _, r := range config.GetConfig().FlyFallbackRegions {
+		if !slices.Contains(regions, r) {
+			regions = append(regions, r)
+		}
+	}
+
+	return regions
+}
@@ -0,0 +1,160 @@
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/fly"
+	"github.com/superfly/lambdo/internal/fly/flytest"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/source"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetupLogging(true)
+	os.Exit(m.Run())
+}
+
+// fakeSource records what the broker acks and nacks
+type fakeSource struct {
+	mu     sync.Mutex
+	acked  []*source.Event
+	nacked []*source.Event
+}
+
+func (s *fakeSource) Name() string {
+	return "fake"
+}
+
+func (s *fakeSource) Receive(ctx context.Context) ([]*source.Event, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *fakeSource) Ack(ctx context.Context, events []*source.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.acked = append(s.acked, events...)
+	return nil
+}
+
+func (s *fakeSource) Nack(ctx context.Context, events []*source.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nacked = append(s.nacked, events...)
+	return nil
+}
+
+func (s *fakeSource) Extend(ctx context.Context, events []*source.Event, d time.Duration) error {
+	return nil
+}
+
+// configure points lambdo at the fake Fly API, waiting for Machines to exit
+func configure(t *testing.T, server *flytest.Server) {
+	t.Setenv("LAMBDO_FLY_TOKEN", "token")
+	t.Setenv("LAMBDO_FLY_APP", "lambdo-test")
+	t.Setenv("LAMBDO_FLY_REGION", "ams")
+	t.Setenv("LAMBDO_FLY_API_URL", server.URL)
+	t.Setenv("LAMBDO_WAIT_FOR_MACHINE", "true")
+
+	if err := config.Configure(); err != nil {
+		t.Fatalf("could not configure lambdo: %v", err)
+	}
+}
+
+// send groups the events and sends each group to a Machine
+func send(t *testing.T, src *fakeSource, events ...*source.Event) {
+	ctx := context.Background()
+	collections := GroupEvents(ctx, &source.Batch{
+		Source: src,
+		Events: events,
+	})
+
+	if len(collections) != 1 {
+		t.Fatalf("expected 1 collection, got %d", len(collections))
+	}
+
+	if err := SendToMachine(ctx, collections[0]); err != nil {
+		t.Fatalf("could not send events to a Machine: %v", err)
+	}
+}
+
+func event(id, body string) *source.Event {
+	return &source.Event{
+		Id:           id,
+		Body:         body,
+		Attributes:   map[string]string{"image": "registry.fly.io/app:tag"},
+		ReceiveCount: 1,
+	}
+}
+
+func TestSendToMachineAcksSucceededEvents(t *testing.T) {
+	server := flytest.NewServer()
+	defer server.Close()
+	configure(t, server)
+
+	src := &fakeSource{}
+	send(t, src, event("1", `{"n":1}`), event("2", `{"n":2}`))
+
+	if len(src.acked) != 2 || len(src.nacked) != 0 {
+		t.Fatalf("expected 2 acked and 0 nacked events, got %d and %d", len(src.acked), len(src.nacked))
+	}
+
+	machines := server.Machines()
+	if len(machines) != 1 {
+		t.Fatalf("expected 1 Machine, got %d", len(machines))
+	}
+
+	m := machines[0]
+	if m.Region != "ams" || m.Config.Image != "registry.fly.io/app:tag" || !m.Config.AutoDestroy {
+		t.Errorf("unexpected Machine region %s, image %s or auto-destroy %t", m.Region, m.Config.Image, m.Config.AutoDestroy)
+	}
+
+	events, _ := base64.StdEncoding.DecodeString(m.Config.Files[0].RawValue)
+	if string(events) != `[{"n":1},{"n":2}]` {
+		t.Errorf("unexpected events file %s", events)
+	}
+}
+
+func TestSendToMachineNacksFailedEvents(t *testing.T) {
+	server := flytest.NewServer()
+	server.ExitCode = func(m *fly.Machine) int {
+		return 1
+	}
+	defer server.Close()
+	configure(t, server)
+
+	src := &fakeSource{}
+	send(t, src, event("1", `{}`))
+
+	if len(src.acked) != 0 || len(src.nacked) != 1 {
+		t.Fatalf("expected 0 acked and 1 nacked events, got %d and %d", len(src.acked), len(src.nacked))
+	}
+}
+
+func TestSendToMachineNacksEventsWithoutMachine(t *testing.T) {
+	server := flytest.NewServer()
+	server.CreateStatus = func(m *fly.Machine) int {
+		return http.StatusUnprocessableEntity
+	}
+	defer server.Close()
+	configure(t, server)
+
+	src := &fakeSource{}
+	send(t, src, event("1", `{}`))
+
+	if len(src.acked) != 0 || len(src.nacked) != 1 {
+		t.Fatalf("expected 0 acked and 1 nacked events, got %d and %d", len(src.acked), len(src.nacked))
+	}
+
+	if machines := server.Machines(); len(machines) != 0 {
+		t.Errorf("expected no Machines, got %d", len(machines))
+	}
+}
@@ -0,0 +1,64 @@
+package broker
+
+import (
+	"context"
+	"github.com/superfly/lambdo/internal/dlq"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/metrics"
+	"github.com/superfly/lambdo/internal/source"
+	"go.uber.org/zap"
+)
+
+// deadLetter moves any of the given (failed) events that were delivered
+// too many times to the dead-letter queue and acks them from their source.
+// Events that are not dead-lettered are returned, so the caller can decide
+// what to do with them. This goes ahead even if the context was cancelled,
+// so events aren't left hanging on shutdown.
+func deadLetter(ctx context.Context, src source.EventSource, events []*source.Event, reason string) []*source.Event {
+	ctx = context.WithoutCancel(ctx)
+	remaining := []*source.Event{}
+	deadLettered := []*source.Event{}
+
+	for _, e := range events {
+		if !dlq.ShouldDeadLetter(e) {
+			remaining = append(remaining, e)
+			continue
+		}
+
+		if err := dlq.GetQueue().Send(ctx, e, reason); err != nil {
+			logging.GetLogger().Error("could not dead-letter event", zap.String("event-id", e.Id), zap.Error(err))
+			remaining = append(remaining, e)
+			continue
+		}
+
+		logging.GetLogger().Warn("event dead-lettered", zap.String("event-id", e.Id), zap.Int("receive-count", e.ReceiveCount), zap.String("reason", reason))
+		deadLettered = append(deadLettered, e)
+	}
+
+	if len(deadLettered) > 0 {
+		metrics.MessagesDeadLettered.WithLabelValues(src.Name()).Add(float64(len(deadLettered)))
+		if err := src.Ack(ctx, deadLettered); err != nil {
+			logging.GetLogger().Error("events dead-lettered but could not ack them", zap.String("source", src.Name()), zap.Error(err))
+		} else {
+			metrics.MessagesAcked.WithLabelValues(src.Name()).Add(float64(len(deadLettered)))
+		}
+	}
+
+	return remaining
+}
+
+// retryOrDeadLetter dead-letters the given (failed) events that were
+// delivered too many times, and nacks the rest so their source
+// redelivers them. Not every source redelivers events on its own.
+func retryOrDeadLetter(ctx context.Context, src source.EventSource, events []*source.Event, reason string) {
+	remaining := deadLetter(ctx, src, events, reason)
+	if len(remaining) == 0 {
+		return
+	}
+
+	if err := src.Nack(context.WithoutCancel(ctx), remaining); err != nil {
+		logging.GetLogger().Error("could not nack failed events", zap.String("source", src.Name()), zap.Error(err))
+	} else {
+		metrics.MessagesNacked.WithLabelValues(src.Name()).Add(float64(len(remaining)))
+	}
+}
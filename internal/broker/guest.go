@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"fmt"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/fly"
+	"github.com/superfly/lambdo/internal/source"
+	"strconv"
+)
+
+// defaultSize is the Machine size preset used when an
+// event asks for neither a size nor a custom guest
+const defaultSize = "performance-2x"
+
+// findGuest returns the custom Machine (guest) size an event asks for, via
+// its cpu_kind, cpus and memory_mb attributes or a configured size profile.
+// Values missing from the event fall back to the profile (if any), then to
+// a shared CPU and the least memory allowed. A nil guest means the event
+// did not ask for a custom size.
+func findGuest(event *source.Event) (*fly.MachineSize, error) {
+	guest := fly.MachineSize{}
+	custom := false
+
+	if name, ok := event.Attribute("profile"); ok {
+		profile, found := config.GetConfig().SizeProfiles[name]
+		if !found {
+			return nil, fmt.Errorf("unknown size profile '%s'", name)
+		}
+
+		guest = fly.MachineSize{
+			Type:     profile.CpuKind,
+			CpuCount: profile.Cpus,
+			RAM:      profile.MemoryMb,
+		}
+		custom = true
+	}
+
+	if kind, ok := event.Attribute("cpu_kind"); ok {
+		guest.Type = kind
+		custom = true
+	}
+
+	for attr, value := range map[string]*int{"cpus": &guest.CpuCount, "memory_mb": &guest.RAM} {
+		raw, ok := event.Attribute(attr)
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number, got '%s'", attr, raw)
+		}
+
+		*value = n
+		custom = true
+	}
+
+	if !custom {
+		return nil, nil
+	}
+
+	if len(guest.Type) == 0 {
+		guest.Type = fly.TypeShared
+	}
+
+	if guest.CpuCount == 0 {
+		guest.CpuCount = 1
+	}
+
+	if guest.RAM == 0 {
+		guest.RAM = minMemoryMb(guest.Type) * guest.CpuCount
+	}
+
+	if err := guest.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &guest, nil
+}
+
+// minMemoryMb is the least memory per CPU a
+// Machine with the given kind of CPU can have
+func minMemoryMb(cpuKind string) int {
+	if cpuKind == fly.TypePerf {
+		return 2048
+	}
+
+	return 256
+}
+
+// guestKey describes a guest size for grouping events,
+// which is empty if no custom size was asked for
+func guestKey(guest *fly.MachineSize) string {
+	if guest == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%s:%d:%d", guest.Type, guest.CpuCount, guest.RAM)
+}
@@ -0,0 +1,66 @@
+package broker
+
+import (
+	"github.com/superfly/lambdo/internal/metrics"
+	"sync"
+)
+
+// InFlight counts the work being handled for an image right now
+type InFlight struct {
+	// Collections are groups of events, each
+	// waiting on or running in a Machine
+	Collections int `json:"collections"`
+	Events      int `json:"events"`
+}
+
+type inFlightCounter struct {
+	mu     sync.Mutex
+	images map[string]*InFlight
+}
+
+var inFlight = &inFlightCounter{
+	images: map[string]*InFlight{},
+}
+
+// add counts a collection as in flight until
+// the returned function is called
+func (c *inFlightCounter) add(collection *EventCollection) (done func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts, ok := c.images[collection.Image]
+	if !ok {
+		counts = &InFlight{}
+		c.images[collection.Image] = counts
+	}
+
+	counts.Collections++
+	counts.Events += len(collection.Events)
+	metrics.JobsInFlight.WithLabelValues(collection.Image).Inc()
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		counts.Collections--
+		counts.Events -= len(collection.Events)
+		metrics.JobsInFlight.WithLabelValues(collection.Image).Dec()
+		if counts.Collections == 0 {
+			delete(c.images, collection.Image)
+			metrics.JobsInFlight.DeleteLabelValues(collection.Image)
+		}
+	}
+}
+
+// InFlightByImage returns what is being handled right now, per image
+func InFlightByImage() map[string]InFlight {
+	inFlight.mu.Lock()
+	defer inFlight.mu.Unlock()
+
+	counts := make(map[string]InFlight, len(inFlight.images))
+	for image, c := range inFlight.images {
+		counts[image] = *c
+	}
+
+	return counts
+}
@@ -0,0 +1,63 @@
+package broker
+
+import (
+	"github.com/superfly/lambdo/internal/fly"
+	"github.com/superfly/lambdo/internal/jobs"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/metrics"
+	"go.uber.org/zap"
+	"time"
+)
+
+// beginJob records a new attempt at handling the collection's events.
+// Job store errors are logged, but never stop events being handled.
+func beginJob(collection *EventCollection) {
+	collection.dispatchedAt = time.Now()
+
+	err := jobs.GetStore().Begin(&jobs.Job{
+		Id:         collection.JobId,
+		Source:     collection.Source.Name(),
+		MessageIds: collection.messageIds(),
+		Aliases:    collection.assignedJobIds(),
+		Image:      collection.Image,
+		Region:     collection.Region,
+	})
+
+	if err != nil {
+		logging.GetLogger().Warn("could not record job", zap.String("job-id", collection.JobId), zap.Error(err))
+	}
+}
+
+// startJob records the Machine a job is running on
+func startJob(jobId string, machine *fly.Machine) {
+	updateJob(jobId, func(job *jobs.Job) {
+		now := time.Now().UTC()
+		job.Status = jobs.StatusStarted
+		job.MachineId = machine.Id
+		job.Region = machine.Region
+		job.StartedAt = &now
+	})
+}
+
+// finishJob records the outcome of a job
+func finishJob(collection *EventCollection, status jobs.Status, reason string) {
+	observeJob(collection, status)
+
+	updateJob(collection.JobId, func(job *jobs.Job) {
+		now := time.Now().UTC()
+		job.Status = status
+		job.Reason = reason
+		job.FinishedAt = &now
+	})
+}
+
+// observeJob records how long lambdo spent on a job
+func observeJob(collection *EventCollection, status jobs.Status) {
+	metrics.JobDuration.WithLabelValues(string(status)).Observe(time.Since(collection.dispatchedAt).Seconds())
+}
+
+func updateJob(jobId string, update func(job *jobs.Job)) {
+	if err := jobs.GetStore().Update(jobId, update); err != nil {
+		logging.GetLogger().Warn("could not update job", zap.String("job-id", jobId), zap.Error(err))
+	}
+}
@@ -0,0 +1,152 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/fly"
+	"github.com/superfly/lambdo/internal/logging"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// Metadata set on every Machine lambdo creates, so we can
+// tell them apart from any other Machines in the app
+const (
+	MetaManaged = "lambdo"
+	MetaImage   = "lambdo_image"
+	MetaPool    = "lambdo_pool"
+	MetaJob     = "lambdo_job_id"
+)
+
+// How long to wait before checking again if a limit was reached
+const limitPollInterval = 5 * time.Second
+
+// limiter caps the number of lambdo Machines running at once,
+// both globally and per image. Machines being created right
+// now are not yet listed by the API, so we reserve a slot
+// for them until their CreateMachine call returns.
+type limiter struct {
+	mu       sync.Mutex
+	reserved map[string]int
+
+	// released counts the reservations given up so far, so a
+	// listing of Machines that raced with one is known to be stale
+	released int
+}
+
+var machineLimiter = &limiter{
+	reserved: map[string]int{},
+}
+
+// acquire blocks until a Machine for the given image can be created
+// without going over any limit. The returned function must be called
+// once the Machine was created (or could not be), and is safe to
+// call more than once.
+func (l *limiter) acquire(ctx context.Context, api *fly.Api, image string) (release func(), err error) {
+	maxTotal := config.GetConfig().MaxMachines
+	maxPerImage := config.GetConfig().MaxMachinesPerImage
+
+	if maxTotal < 1 && maxPerImage < 1 {
+		return func() {}, nil
+	}
+
+	for {
+		ok, err := l.tryReserve(ctx, api, image, maxTotal, maxPerImage)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			// Safe to call more than once
+			var once sync.Once
+			return func() {
+				once.Do(func() {
+					l.mu.Lock()
+					defer l.mu.Unlock()
+					l.reserved[image]--
+					l.released++
+				})
+			}, nil
+		}
+
+		logging.GetLogger().Debug("machine limit reached, waiting", zap.String("image", image))
+
+		// The events stay leased (and therefore in the queue) while we wait
+		select {
+		case <-time.After(limitPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// tryReserve reserves a slot for a Machine of the given image, unless
+// a limit was reached. Machines are listed without holding the lock,
+// so workers don't queue up behind each other's API calls.
+func (l *limiter) tryReserve(ctx context.Context, api *fly.Api, image string, maxTotal, maxPerImage int) (bool, error) {
+	for {
+		l.mu.Lock()
+		released := l.released
+		l.mu.Unlock()
+
+		machines, err := api.ListMachines(ctx, &fly.ListMachinesInput{
+			AppName: config.GetConfig().FlyApp,
+		})
+
+		if err != nil {
+			return false, fmt.Errorf("could not count running machines: %w", err)
+		}
+
+		l.mu.Lock()
+
+		// A Machine created while we were listing may be missing from the
+		// list, and no longer reserved either, so we'd undercount
+		if l.released != released {
+			l.mu.Unlock()
+			continue
+		}
+
+		ok := l.reserve(machines, image, maxTotal, maxPerImage)
+		l.mu.Unlock()
+
+		return ok, nil
+	}
+}
+
+// reserve counts the listed and reserved Machines, and reserves a slot
+// if no limit was reached. It must be called with the lock held.
+func (l *limiter) reserve(machines *fly.ListMachinesResponse, image string, maxTotal, maxPerImage int) bool {
+	total := 0
+	perImage := 0
+	for _, m := range machines.Machines {
+		if m.Config.MetaData[MetaManaged] != "true" || m.IsFinished() {
+			continue
+		}
+
+		total++
+		if m.Config.MetaData[MetaImage] == image {
+			perImage++
+		}
+	}
+
+	for i, reserved := range l.reserved {
+		total += reserved
+		if i == image {
+			perImage += reserved
+		}
+	}
+
+	if maxTotal > 0 && total >= maxTotal {
+		return false
+	}
+
+	if maxPerImage > 0 && perImage >= maxPerImage {
+		return false
+	}
+
+	l.reserved[image]++
+
+	return true
+}
@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"context"
+	"github.com/superfly/lambdo/internal/logging"
+	"go.uber.org/zap"
+	"sync"
+)
+
+// Pool dispatches event collections to a bounded
+// number of workers, each calling SendToMachine
+type Pool struct {
+	concurrency int
+	collections chan *EventCollection
+	working     *sync.WaitGroup
+	errors      chan<- error
+}
+
+// NewPool creates a worker pool. Every submitted collection is tracked
+// in the working WaitGroup until its worker finishes with it, and any
+// errors returned by SendToMachine are sent to the errors channel.
+func NewPool(concurrency int, working *sync.WaitGroup, errors chan<- error) *Pool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &Pool{
+		concurrency: concurrency,
+		// Unbuffered, so Submit blocks while every worker is busy
+		collections: make(chan *EventCollection),
+		working:     working,
+		errors:      errors,
+	}
+}
+
+// Start runs the pool's workers until the context is cancelled
+func (p *Pool) Start(ctx context.Context) {
+	for i := 0; i < p.concurrency; i++ {
+		go p.work(ctx, i)
+	}
+}
+
+// Submit hands a collection to the next free worker, blocking until
+// one is available. This is our backpressure: while Submit blocks,
+// no more events are received from the event sources.
+func (p *Pool) Submit(ctx context.Context, collection *EventCollection) error {
+	p.working.Add(1)
+
+	select {
+	case p.collections <- collection:
+		return nil
+	case <-ctx.Done():
+		// The events' leases will run out and they'll be redelivered
+		p.working.Done()
+		collection.Release()
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) work(ctx context.Context, worker int) {
+	for {
+		select {
+		case collection := <-p.collections:
+			logging.GetLogger().Debug("worker dispatching events", zap.Int("worker", worker), zap.String("image", collection.Image), zap.Int("events", len(collection.Events)))
+
+			if err := SendToMachine(ctx, collection); err != nil {
+				select {
+				case p.errors <- err:
+				case <-ctx.Done():
+					logging.GetLogger().Error("broker error", zap.Error(err))
+				}
+			}
+
+			p.working.Done()
+		case <-ctx.Done():
+			logging.GetLogger().Debug("Shutdown: worker stopped", zap.Int("worker", worker))
+			return
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/fly"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"time"
+)
+
+// waitForMachine blocks until the given Machine, launched at the given
+// time, exits. It returns true only if the workload succeeded. An error
+// means we could not tell how the workload went.
+func waitForMachine(ctx context.Context, api *fly.Api, m *fly.Machine, launchedAt time.Time) (succeeded bool, err error) {
+	logging.GetLogger().Debug("waiting for machine to exit", zap.String("machine-id", m.Id))
+
+	ctx, span := tracing.Start(ctx, "broker.waitForMachine", trace.WithAttributes(attribute.String("fly.machine_id", m.Id)))
+	defer func() {
+		span.SetAttributes(attribute.Bool("lambdo.succeeded", succeeded))
+		tracing.End(span, err)
+	}()
+
+	exit, err := api.WaitForMachineExit(ctx, &fly.WaitForMachineExitInput{
+		AppName:    config.GetConfig().FlyApp,
+		MachineId:  m.Id,
+		InstanceId: m.InstanceId,
+		MaxWait:    time.Duration(config.GetConfig().MachineWaitSeconds) * time.Second,
+		After:      launchedAt,
+	})
+
+	if err != nil {
+		return false, fmt.Errorf("could not wait for machine to exit: %w", err)
+	}
+
+	if !exit.Succeeded() {
+		logging.GetLogger().Warn(
+			"machine exited unsuccessfully",
+			zap.String("machine-id", m.Id),
+			zap.Int("exit-code", exit.ExitCode),
+			zap.Bool("oom-killed", exit.OOMKilled),
+		)
+		span.SetAttributes(attribute.Int("fly.exit_code", exit.ExitCode))
+		return false, nil
+	}
+
+	logging.GetLogger().Debug("machine exited successfully", zap.String("machine-id", m.Id))
+
+	return true, nil
+}
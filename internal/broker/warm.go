@@ -0,0 +1,212 @@
+package broker
+
+import (
+	"context"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/fly"
+	"github.com/superfly/lambdo/internal/logging"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// How often to look for warm Machines that were idle for too long
+const evictionInterval = 30 * time.Second
+
+type warmMachine struct {
+	Id        string
+	StoppedAt time.Time
+}
+
+// warmPool keeps stopped Machines around, grouped by the
+// collection key (image, size, command and region) they were
+// created for, so later events can re-use them instead of
+// paying for a new Machine every time
+type warmPool struct {
+	mu       sync.Mutex
+	machines map[string][]*warmMachine
+}
+
+var warmMachines = &warmPool{
+	machines: map[string][]*warmMachine{},
+}
+
+// StartWarmPool adopts any stopped Machines left over from a
+// previous run of lambdo, and evicts idle Machines from
+// the pool until the context is cancelled
+func StartWarmPool(ctx context.Context) {
+	if !warmMachines.enabled() {
+		return
+	}
+
+	api := fly.NewApi(config.GetConfig().FlyToken, config.GetConfig().FlyApiUrl)
+	warmMachines.adopt(ctx, api)
+
+	go func() {
+		ticker := time.NewTicker(evictionInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				warmMachines.evictIdle(ctx, api)
+			case <-ctx.Done():
+				logging.GetLogger().Debug("Shutdown: no longer evicting idle warm machines")
+				return
+			}
+		}
+	}()
+}
+
+func (p *warmPool) enabled() bool {
+	return config.GetConfig().WarmPoolSize > 0
+}
+
+// launch takes a stopped Machine from the pool, updates it to run the
+// given config and starts it. It returns nil if there is no Machine to
+// re-use (or re-using one failed), in which case a new one is needed.
+func (p *warmPool) launch(ctx context.Context, api *fly.Api, key string, machineConfig fly.MachineConfig) *fly.Machine {
+	for {
+		wm := p.take(key)
+		if wm == nil {
+			return nil
+		}
+
+		logging.GetLogger().Debug("re-using warm machine", zap.String("machine-id", wm.Id))
+
+		// Stay stopped, so StartMachine below is what actually runs the events
+		m, err := api.UpdateMachine(ctx, &fly.UpdateMachineInput{
+			AppName:    config.GetConfig().FlyApp,
+			MachineId:  wm.Id,
+			Config:     machineConfig,
+			SkipLaunch: true,
+		})
+
+		if err != nil {
+			logging.GetLogger().Error("could not update warm machine, destroying it", zap.Error(err), zap.String("machine-id", wm.Id))
+			p.destroy(ctx, api, wm.Id)
+			continue // try the next one
+		}
+
+		err = api.StartMachine(ctx, &fly.StartMachineInput{
+			AppName:   config.GetConfig().FlyApp,
+			MachineId: wm.Id,
+		})
+
+		if err != nil {
+			logging.GetLogger().Error("could not start warm machine, destroying it", zap.Error(err), zap.String("machine-id", wm.Id))
+			p.destroy(ctx, api, wm.Id)
+			continue
+		}
+
+		return m
+	}
+}
+
+// recycle puts a Machine that finished its work back into the
+// pool, or destroys it if the pool for its key is already full
+func (p *warmPool) recycle(ctx context.Context, api *fly.Api, key string, m *fly.Machine) {
+	p.mu.Lock()
+	full := len(p.machines[key]) >= config.GetConfig().WarmPoolSize
+	if !full {
+		p.machines[key] = append(p.machines[key], &warmMachine{
+			Id:        m.Id,
+			StoppedAt: time.Now(),
+		})
+	}
+	p.mu.Unlock()
+
+	if full {
+		logging.GetLogger().Debug("warm pool is full, destroying machine", zap.String("machine-id", m.Id))
+		p.destroy(ctx, api, m.Id)
+		return
+	}
+
+	logging.GetLogger().Debug("machine returned to warm pool", zap.String("machine-id", m.Id))
+}
+
+// discard stops and destroys a pooled Machine whose outcome is
+// unknown. Pooled Machines don't destroy themselves when they exit,
+// so it would be leaked otherwise. This also happens when lambdo
+// is shutting down, so the context may be cancelled already.
+func (p *warmPool) discard(ctx context.Context, api *fly.Api, m *fly.Machine) {
+	logging.GetLogger().Debug("destroying warm machine with unknown outcome", zap.String("machine-id", m.Id))
+	p.destroy(context.WithoutCancel(ctx), api, m.Id)
+}
+
+// take removes the most recently stopped Machine from the pool
+func (p *warmPool) take(key string) *warmMachine {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	machines := p.machines[key]
+	if len(machines) == 0 {
+		return nil
+	}
+
+	wm := machines[len(machines)-1]
+	p.machines[key] = machines[:len(machines)-1]
+
+	return wm
+}
+
+// evictIdle destroys every Machine that sat in the
+// pool for longer than the configured idle time
+func (p *warmPool) evictIdle(ctx context.Context, api *fly.Api) {
+	idle := time.Duration(config.GetConfig().WarmPoolIdleSeconds) * time.Second
+	evicted := []string{}
+
+	p.mu.Lock()
+	for key, machines := range p.machines {
+		kept := []*warmMachine{}
+		for _, wm := range machines {
+			if time.Since(wm.StoppedAt) > idle {
+				evicted = append(evicted, wm.Id)
+			} else {
+				kept = append(kept, wm)
+			}
+		}
+		p.machines[key] = kept
+	}
+	p.mu.Unlock()
+
+	for _, id := range evicted {
+		logging.GetLogger().Debug("evicting idle warm machine", zap.String("machine-id", id))
+		p.destroy(ctx, api, id)
+	}
+}
+
+// adopt adds stopped, pooled Machines from a previous
+// run of lambdo to the pool, so they aren't leaked
+func (p *warmPool) adopt(ctx context.Context, api *fly.Api) {
+	machines, err := api.ListMachines(ctx, &fly.ListMachinesInput{
+		AppName: config.GetConfig().FlyApp,
+	})
+
+	if err != nil {
+		logging.GetLogger().Error("could not list machines to adopt into the warm pool", zap.Error(err))
+		return
+	}
+
+	for _, m := range machines.Machines {
+		key := m.Config.MetaData[MetaPool]
+		if len(key) == 0 || m.State != "stopped" {
+			continue
+		}
+
+		logging.GetLogger().Debug("adopting warm machine", zap.String("machine-id", m.Id))
+		p.recycle(ctx, api, key, &m)
+	}
+}
+
+func (p *warmPool) destroy(ctx context.Context, api *fly.Api, machineId string) {
+	err := api.DeleteMachine(ctx, &fly.DeleteMachineInput{
+		AppName:   config.GetConfig().FlyApp,
+		MachineId: machineId,
+		Force:     true,
+	})
+
+	if err != nil {
+		logging.GetLogger().Error("could not destroy warm machine", zap.Error(err), zap.String("machine-id", machineId))
+	}
+}
@@ -1,40 +1,229 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/spf13/viper"
+	"golang.org/x/exp/slices"
 	"log"
 	"os"
+	"strings"
 )
 
 type LambdoConfig struct {
-	Environment        string `mapstructure:"env"`
-	SQSLongPollSeconds int    `mapstructure:"sqs_long_poll_seconds"`
-	SQSQueueUrl        string `mapstructure:"sqs_queue_url"`
-	EventsPerMachine   int    `mapstructure:"events_per_machine"`
-	FlyApp             string `mapstructure:"fly_app"`
-	FlyRegion          string `mapstructure:"fly_region"`
-	FlyToken           string `mapstructure:"fly_token"`
+	Environment               string   `mapstructure:"env"`
+	PollSeconds               int      `mapstructure:"poll_seconds"`
+	SQSQueueUrl               string   `mapstructure:"sqs_queue_url"`
+	EventsPerMachine          int      `mapstructure:"events_per_machine"`
+	FlyApp                    string   `mapstructure:"fly_app"`
+	FlyRegion                 string   `mapstructure:"fly_region"`
+	FlyFallbackRegions        []string `mapstructure:"-"`
+	FlyToken                  string   `mapstructure:"fly_token"`
+	WaitForMachine            bool     `mapstructure:"wait_for_machine"`
+	MachineWaitSeconds        int      `mapstructure:"machine_wait_seconds"`
+	LeaseSeconds              int      `mapstructure:"lease_seconds"`
+	SQSRetryDelaySeconds      int      `mapstructure:"sqs_retry_delay_seconds"`
+	HeartbeatSeconds          int      `mapstructure:"heartbeat_seconds"`
+	MaxReceiveCount           int      `mapstructure:"max_receive_count"`
+	DLQSQSQueueUrl            string   `mapstructure:"dlq_sqs_queue_url"`
+	DLQPath                   string   `mapstructure:"dlq_path"`
+	BrokerConcurrency         int      `mapstructure:"broker_concurrency"`
+	MaxMachines               int      `mapstructure:"max_machines"`
+	MaxMachinesPerImage       int      `mapstructure:"max_machines_per_image"`
+	WarmPoolSize              int      `mapstructure:"warm_pool_size"`
+	WarmPoolIdleSeconds       int      `mapstructure:"warm_pool_idle_seconds"`
+	FlyApiUrl                 string   `mapstructure:"fly_api_url"`
+	JobsDBPath                string   `mapstructure:"jobs_db_path"`
+	JobsRetentionHours        int      `mapstructure:"jobs_retention_hours"`
+	AdminAddr                 string   `mapstructure:"admin_addr"`
+	AdminToken                string   `mapstructure:"admin_token"`
+	TracingExporter           string   `mapstructure:"tracing_exporter"`
+	TracingEndpoint           string   `mapstructure:"tracing_endpoint"`
+	WebhookAddr               string   `mapstructure:"webhook_addr"`
+	WebhookToken              string   `mapstructure:"webhook_token"`
+	WebhookQueueSize          int      `mapstructure:"webhook_queue_size"`
+	RedisUrl                  string   `mapstructure:"redis_url"`
+	RedisStream               string   `mapstructure:"redis_stream"`
+	RedisGroup                string   `mapstructure:"redis_group"`
+	RedisConsumer             string   `mapstructure:"redis_consumer"`
+	RedisRetryDelaySeconds    int      `mapstructure:"redis_retry_delay_seconds"`
+	NatsUrl                   string   `mapstructure:"nats_url"`
+	NatsCredsFile             string   `mapstructure:"nats_creds_file"`
+	NatsStream                string   `mapstructure:"nats_stream"`
+	NatsConsumer              string   `mapstructure:"nats_consumer"`
+	NatsSubject               string   `mapstructure:"nats_subject"`
+	NatsNakDelaySeconds       int      `mapstructure:"nats_nak_delay_seconds"`
+	PostgresUrl               string   `mapstructure:"postgres_url"`
+	PostgresTable             string   `mapstructure:"postgres_table"`
+	PostgresRetryDelaySeconds int      `mapstructure:"postgres_retry_delay_seconds"`
+	AMQPUrl                   string   `mapstructure:"amqp_url"`
+	AMQPQueue                 string   `mapstructure:"amqp_queue"`
+	AMQPPrefetch              int      `mapstructure:"amqp_prefetch"`
+	AMQPQueueType             string   `mapstructure:"amqp_queue_type"`
+	AMQPRetryDelaySeconds     int      `mapstructure:"amqp_retry_delay_seconds"`
+	KafkaBrokers              []string `mapstructure:"-"`
+	KafkaTopics               []string `mapstructure:"-"`
+	KafkaGroup                string   `mapstructure:"kafka_group"`
+	KafkaOrdered              bool     `mapstructure:"kafka_ordered"`
+	KafkaRetryDelaySeconds    int      `mapstructure:"kafka_retry_delay_seconds"`
+
+	// SizeProfiles are named Machine sizes events can ask for
+	SizeProfiles map[string]SizeProfile `mapstructure:"-"`
+
+	// Schedules are workloads lambdo runs on its own, cron-style
+	Schedules []Schedule `mapstructure:"-"`
+}
+
+// SizeProfile is a named, custom Machine (guest) size
+type SizeProfile struct {
+	CpuKind  string `mapstructure:"cpu_kind" json:"cpu_kind"`
+	Cpus     int    `mapstructure:"cpus" json:"cpus"`
+	MemoryMb int    `mapstructure:"memory_mb" json:"memory_mb"`
+}
+
+// Schedule is a workload run on a cron schedule, as if an
+// event with the schedule's payload and attributes was received
+type Schedule struct {
+	// Name identifies the schedule, and must be unique
+	Name string `mapstructure:"name" json:"name"`
+
+	// Cron is a standard cron expression, e.g. "0 3 * * *",
+	// or a descriptor such as "@hourly"
+	Cron    string   `mapstructure:"cron" json:"cron"`
+	Image   string   `mapstructure:"image" json:"image"`
+	Size    string   `mapstructure:"size" json:"size"`
+	Command []string `mapstructure:"command" json:"command"`
+	Region  string   `mapstructure:"region" json:"region"`
+	Payload any      `mapstructure:"payload" json:"payload"`
+
+	// MissedRuns is what to do about runs missed while lambdo was
+	// not running: "skip" them (default), or "run_once" to run
+	// the most recently missed one on start
+	MissedRuns string `mapstructure:"missed_runs" json:"missed_runs"`
 }
 
 var lambdoConfig *LambdoConfig
 
+// renamedKeys maps the old names of keys to their new
+// ones, which aren't specific to SQS anymore
+var renamedKeys = map[string]string{
+	"sqs_long_poll_seconds":  "poll_seconds",
+	"sqs_visibility_timeout": "lease_seconds",
+}
+
 func Configure() error {
 	v := viper.New()
 	v.SetEnvPrefix("lambdo")
 	v.AutomaticEnv()
 
 	v.BindEnv("env")
-	v.BindEnv("sqs_long_poll_seconds")
+	v.BindEnv("poll_seconds", "LAMBDO_POLL_SECONDS", "LAMBDO_SQS_LONG_POLL_SECONDS")
 	v.BindEnv("sqs_queue_url")
 	v.BindEnv("events_per_machine")
 	v.BindEnv("fly_app")
 	v.BindEnv("fly_region")
+	v.BindEnv("fly_fallback_regions")
 	v.BindEnv("fly_token")
+	v.BindEnv("wait_for_machine")
+	v.BindEnv("machine_wait_seconds")
+	v.BindEnv("lease_seconds", "LAMBDO_LEASE_SECONDS", "LAMBDO_SQS_VISIBILITY_TIMEOUT")
+	v.BindEnv("sqs_retry_delay_seconds")
+	v.BindEnv("heartbeat_seconds")
+	v.BindEnv("max_receive_count")
+	v.BindEnv("dlq_sqs_queue_url")
+	v.BindEnv("dlq_path")
+	v.BindEnv("broker_concurrency")
+	v.BindEnv("max_machines")
+	v.BindEnv("max_machines_per_image")
+	v.BindEnv("warm_pool_size")
+	v.BindEnv("warm_pool_idle_seconds")
+	v.BindEnv("fly_api_url")
+	v.BindEnv("jobs_db_path")
+	v.BindEnv("jobs_retention_hours")
+	v.BindEnv("admin_addr")
+	v.BindEnv("admin_token")
+	v.BindEnv("tracing_exporter")
+	v.BindEnv("tracing_endpoint")
+	v.BindEnv("webhook_addr")
+	v.BindEnv("webhook_token")
+	v.BindEnv("webhook_queue_size")
+	v.BindEnv("redis_url")
+	v.BindEnv("redis_stream")
+	v.BindEnv("redis_group")
+	v.BindEnv("redis_consumer")
+	v.BindEnv("redis_retry_delay_seconds")
+	v.BindEnv("nats_url")
+	v.BindEnv("nats_creds_file")
+	v.BindEnv("nats_stream")
+	v.BindEnv("nats_consumer")
+	v.BindEnv("nats_subject")
+	v.BindEnv("nats_nak_delay_seconds")
+	v.BindEnv("postgres_url")
+	v.BindEnv("postgres_table")
+	v.BindEnv("postgres_retry_delay_seconds")
+	v.BindEnv("amqp_url")
+	v.BindEnv("amqp_queue")
+	v.BindEnv("amqp_prefetch")
+	v.BindEnv("amqp_queue_type")
+	v.BindEnv("amqp_retry_delay_seconds")
+	v.BindEnv("kafka_brokers")
+	v.BindEnv("kafka_topics")
+	v.BindEnv("kafka_group")
+	v.BindEnv("kafka_ordered")
+	v.BindEnv("kafka_retry_delay_seconds")
+
+	v.BindEnv("size_profiles")
+	v.BindEnv("schedules")
 
 	v.SetDefault("env", "local")
-	v.SetDefault("sqs_long_poll_seconds", 10)
+	v.SetDefault("poll_seconds", 10)
 	v.SetDefault("events_per_machine", 5)
+	v.SetDefault("wait_for_machine", false)
+	v.SetDefault("machine_wait_seconds", 900)
+	v.SetDefault("lease_seconds", 30)
+	v.SetDefault("sqs_retry_delay_seconds", 30)
+	v.SetDefault("heartbeat_seconds", 10)
+	v.SetDefault("max_receive_count", 5)
+	v.SetDefault("broker_concurrency", 4)
+	v.SetDefault("max_machines", 0)
+	v.SetDefault("max_machines_per_image", 0)
+	v.SetDefault("warm_pool_size", 0)
+	v.SetDefault("warm_pool_idle_seconds", 300)
+	v.SetDefault("fly_api_url", "https://api.machines.dev")
+	v.SetDefault("jobs_retention_hours", 168)
+	v.SetDefault("tracing_exporter", "none")
+	v.SetDefault("webhook_queue_size", 1000)
+	v.SetDefault("redis_stream", "lambdo")
+	v.SetDefault("redis_group", "lambdo")
+	v.SetDefault("redis_retry_delay_seconds", 10)
+	v.SetDefault("nats_stream", "lambdo")
+	v.SetDefault("nats_consumer", "lambdo")
+	v.SetDefault("nats_nak_delay_seconds", 10)
+	v.SetDefault("postgres_table", "lambdo_jobs")
+	v.SetDefault("postgres_retry_delay_seconds", 10)
+	v.SetDefault("amqp_queue", "lambdo")
+	v.SetDefault("amqp_prefetch", 0)
+	v.SetDefault("amqp_queue_type", "quorum")
+	v.SetDefault("amqp_retry_delay_seconds", 10)
+	v.SetDefault("kafka_group", "lambdo")
+	v.SetDefault("kafka_ordered", false)
+	v.SetDefault("kafka_retry_delay_seconds", 10)
+
+	// Optional config file (toml, yaml or json), for anything that's awkward
+	// to set in an environment variable. Environment variables win.
+	if path := os.Getenv("LAMBDO_CONFIG_FILE"); len(path) > 0 {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return fmt.Errorf("could not read config file: %w", err)
+		}
+
+		// The old names of renamed keys still work, unless the new one is set too
+		for old, key := range renamedKeys {
+			if v.InConfig(old) {
+				v.SetDefault(key, v.Get(old))
+			}
+		}
+	}
 
 	config := &LambdoConfig{}
 	err := v.Unmarshal(&config)
@@ -43,6 +232,16 @@ func Configure() error {
 		return err
 	}
 
+	// A table in the config file, or JSON in LAMBDO_SIZE_PROFILES
+	if err := unmarshalKey(v, "size_profiles", &config.SizeProfiles); err != nil {
+		return err
+	}
+
+	// An array of tables in the config file, or JSON in LAMBDO_SCHEDULES
+	if err := unmarshalKey(v, "schedules", &config.Schedules); err != nil {
+		return err
+	}
+
 	// Pick these up from Fly runtime environment variables
 	// if not set explicitly
 	if len(config.FlyApp) == 0 {
@@ -53,7 +252,54 @@ func Configure() error {
 		config.FlyRegion = os.Getenv("FLY_REGION")
 	}
 
-	// Some quick validation
+	// Comma-separated, e.g. "ams,fra,cdg", or a list in the config file
+	config.FlyFallbackRegions = stringList(v, "fly_fallback_regions")
+	config.KafkaBrokers = stringList(v, "kafka_brokers")
+	config.KafkaTopics = stringList(v, "kafka_topics")
+
+	if config.EventsPerMachine > 10 {
+		log.Println("config events_per_machine set higher than 10, using value 10")
+		config.EventsPerMachine = 10
+	}
+
+	if config.LeaseSeconds < 1 {
+		return fmt.Errorf("config lease_seconds must be at least 1 second")
+	}
+
+	if config.HeartbeatSeconds >= config.LeaseSeconds {
+		return fmt.Errorf("config heartbeat_seconds must be lower than lease_seconds")
+	}
+
+	// The longest visibility timeout SQS allows is 12 hours
+	if config.SQSRetryDelaySeconds < 0 || config.SQSRetryDelaySeconds > 43200 {
+		return fmt.Errorf("config sqs_retry_delay_seconds must be between 0 and 43200")
+	}
+
+	// Entries can't be left idle for longer than it takes to reclaim them
+	if len(config.RedisUrl) > 0 && (config.RedisRetryDelaySeconds < 0 || config.RedisRetryDelaySeconds > config.LeaseSeconds) {
+		return fmt.Errorf("config redis_retry_delay_seconds must be between 0 and lease_seconds")
+	}
+
+	if config.AMQPRetryDelaySeconds < 0 {
+		return fmt.Errorf("config amqp_retry_delay_seconds must not be negative")
+	}
+
+	if config.JobsRetentionHours < 0 {
+		return fmt.Errorf("config jobs_retention_hours must not be negative")
+	}
+
+	if !slices.Contains([]string{"none", "stdout", "otlp"}, config.TracingExporter) {
+		return fmt.Errorf("config tracing_exporter must be one of none, stdout or otlp")
+	}
+
+	lambdoConfig = config
+
+	return nil
+}
+
+// ValidateFly checks the config needed to create Machines is set. It's
+// not part of Configure, as not every command talks to Fly.
+func (config *LambdoConfig) ValidateFly() error {
 	if len(config.FlyToken) == 0 {
 		return fmt.Errorf("config LAMBDO_FLY_TOKEN must be set")
 	}
@@ -66,16 +312,51 @@ func Configure() error {
 		return fmt.Errorf("No values found for LAMBDO_FLY_REGION nor FLY_REGION")
 	}
 
-	if config.EventsPerMachine > 10 {
-		log.Println("config events_per_machine set higher than 10, using value 10")
-		config.EventsPerMachine = 10
+	return nil
+}
+
+func GetConfig() *LambdoConfig {
+	return lambdoConfig
+}
+
+// unmarshalKey decodes a nested config value, which is either
+// structured (from the config file) or a JSON string (from an
+// environment variable)
+func unmarshalKey(v *viper.Viper, key string, rawVal any) error {
+	if !v.IsSet(key) {
+		return nil
 	}
 
-	lambdoConfig = config
+	if s, ok := v.Get(key).(string); ok {
+		if err := json.Unmarshal([]byte(s), rawVal); err != nil {
+			return fmt.Errorf("config %s is not valid JSON: %w", key, err)
+		}
+		return nil
+	}
+
+	if err := v.UnmarshalKey(key, rawVal); err != nil {
+		return fmt.Errorf("config %s is invalid: %w", key, err)
+	}
 
 	return nil
 }
 
-func GetConfig() *LambdoConfig {
-	return lambdoConfig
+// stringList reads a list config value, which is either a list
+// (from the config file) or a comma-separated string
+func stringList(v *viper.Viper, key string) []string {
+	var values []string
+	if s, ok := v.Get(key).(string); ok {
+		values = strings.Split(s, ",")
+	} else {
+		values = v.GetStringSlice(key)
+	}
+
+	list := []string{}
+	for _, value := range values {
+		if value = strings.TrimSpace(value); len(value) > 0 {
+			list = append(list, value)
+		}
+	}
+
+	return list
 }
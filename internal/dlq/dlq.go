@@ -0,0 +1,80 @@
+package dlq
+
+import (
+	"context"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/source"
+	"strconv"
+	"time"
+)
+
+// Attribute names added to dead-lettered events
+const (
+	AttrFailureReason = "lambdo_failure_reason"
+	AttrReceiveCount  = "lambdo_receive_count"
+	AttrFailedAt      = "lambdo_failed_at"
+
+	// AttrAttributes holds the event's own attributes as a JSON
+	// object, if they don't fit next to the failure details
+	AttrAttributes = "lambdo_attributes"
+)
+
+// DeadLetterQueue is where events go when they
+// repeatedly fail to be handled
+type DeadLetterQueue interface {
+	Send(ctx context.Context, e *source.Event, reason string) error
+}
+
+var queue DeadLetterQueue
+
+// Configure sets up the dead-letter queue based on
+// the lambdo config. If neither an SQS dead-letter queue
+// nor a local path is configured, dead-lettering is disabled.
+func Configure() error {
+	if len(config.GetConfig().DLQSQSQueueUrl) > 0 {
+		queue = &SQSQueue{
+			QueueUrl: config.GetConfig().DLQSQSQueueUrl,
+		}
+		return nil
+	}
+
+	if len(config.GetConfig().DLQPath) > 0 {
+		fs, err := NewFileStore(config.GetConfig().DLQPath)
+		if err != nil {
+			return err
+		}
+
+		queue = fs
+	}
+
+	return nil
+}
+
+// GetQueue returns the configured dead-letter
+// queue, or nil if there is none
+func GetQueue() DeadLetterQueue {
+	return queue
+}
+
+// ShouldDeadLetter returns true if the event was delivered
+// more times than allowed and a dead-letter queue is configured
+func ShouldDeadLetter(e *source.Event) bool {
+	maxReceives := config.GetConfig().MaxReceiveCount
+
+	return queue != nil && maxReceives > 0 && e.ReceiveCount >= maxReceives
+}
+
+// failureAttributes returns a copy of the event's attributes
+// with the failure details attached
+func failureAttributes(e *source.Event, reason string) map[string]string {
+	attributes := map[string]string{}
+	for k, v := range e.Attributes {
+		attributes[k] = v
+	}
+
+	attributes[AttrFailureReason] = reason
+	attributes[AttrReceiveCount] = strconv.Itoa(e.ReceiveCount)
+	attributes[AttrFailedAt] = time.Now().UTC().Format(time.RFC3339)
+
+	return attributes
+}
@@ -0,0 +1,56 @@
+package dlq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/superfly/lambdo/internal/source"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileStore writes each dead-lettered event to
+// its own JSON file within a local directory
+type FileStore struct {
+	Path string
+}
+
+type fileEvent struct {
+	Id         string            `json:"id"`
+	Body       string            `json:"body"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// NewFileStore returns a FileStore, creating its
+// directory if it does not exist yet
+func NewFileStore(path string) (*FileStore, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create dead-letter directory: %w", err)
+	}
+
+	return &FileStore{
+		Path: path,
+	}, nil
+}
+
+func (s *FileStore) Send(ctx context.Context, e *source.Event, reason string) error {
+	j, err := json.MarshalIndent(&fileEvent{
+		Id:         e.Id,
+		Body:       e.Body,
+		Attributes: failureAttributes(e, reason),
+	}, "", "  ")
+
+	if err != nil {
+		return fmt.Errorf("could not encode dead-lettered event to JSON: %w", err)
+	}
+
+	// Event IDs are source-specific and may contain
+	// anything, so we don't trust them in file names
+	name := fmt.Sprintf("%d.json", time.Now().UnixNano())
+	if err := os.WriteFile(filepath.Join(s.Path, name), j, 0o644); err != nil {
+		return fmt.Errorf("could not write dead-lettered event: %w", err)
+	}
+
+	return nil
+}
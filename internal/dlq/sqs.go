@@ -0,0 +1,49 @@
+package dlq
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/superfly/lambdo/internal/source"
+	"github.com/superfly/lambdo/internal/sqs"
+)
+
+// SQS rejects messages with more attributes than this
+const maxSQSAttributes = 10
+
+// SQSQueue sends dead-lettered events to an SQS queue,
+// with the failure details as message attributes
+type SQSQueue struct {
+	QueueUrl string
+}
+
+func (q *SQSQueue) Send(ctx context.Context, e *source.Event, reason string) error {
+	attributes, err := sqsAttributes(e, reason)
+	if err != nil {
+		return err
+	}
+
+	return sqs.SendMessage(ctx, q.QueueUrl, e.Body, attributes)
+}
+
+// sqsAttributes returns the event's attributes with the failure details
+// attached. If there are too many of them for SQS, the event's own
+// attributes are merged into a single JSON attribute, so the failure
+// details always fit.
+func sqsAttributes(e *source.Event, reason string) (map[string]string, error) {
+	attributes := failureAttributes(e, reason)
+	if len(attributes) <= maxSQSAttributes {
+		return attributes, nil
+	}
+
+	merged, err := json.Marshal(e.Attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		AttrAttributes:    string(merged),
+		AttrFailureReason: attributes[AttrFailureReason],
+		AttrReceiveCount:  attributes[AttrReceiveCount],
+		AttrFailedAt:      attributes[AttrFailedAt],
+	}, nil
+}
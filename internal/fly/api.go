@@ -1,12 +1,30 @@
 package fly
 
+import "strings"
+
+// DefaultBaseUrl is the public Fly Machines API. Within Fly's private
+// network, "http://_api.internal:4280" can be used instead.
+const DefaultBaseUrl = "https://api.machines.dev"
+
 type Api struct {
-	Token string
+	Token   string
+	BaseUrl string
+
+	// RetryPolicy decides how failed requests are retried,
+	// DefaultRetryPolicy() is used if it's nil
+	RetryPolicy *RetryPolicy
 }
 
-// NewApi returns an instance of the Fly API
-func NewApi(token string) *Api {
+// NewApi returns an instance of the Fly API. An empty
+// base URL means the public Fly Machines API is used.
+func NewApi(token, baseUrl string) *Api {
+	if len(baseUrl) == 0 {
+		baseUrl = DefaultBaseUrl
+	}
+
 	return &Api{
-		Token: token,
+		Token:       token,
+		BaseUrl:     strings.TrimSuffix(baseUrl, "/"),
+		RetryPolicy: DefaultRetryPolicy(),
 	}
 }
@@ -0,0 +1,160 @@
+package fly_test
+
+import (
+	"context"
+	"errors"
+	"github.com/superfly/lambdo/internal/fly"
+	"github.com/superfly/lambdo/internal/fly/flytest"
+	"github.com/superfly/lambdo/internal/logging"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logging.SetupLogging(true)
+	os.Exit(m.Run())
+}
+
+// fastRetries retries right away, so tests don't wait on backoff
+func fastRetries(attempts int) *fly.RetryPolicy {
+	return &fly.RetryPolicy{
+		MaxAttempts:    attempts,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		MaxElapsed:     time.Minute,
+	}
+}
+
+func TestCreateMachineRetries(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *fly.RetryPolicy
+		// statuses are what the fake API fails each attempt with, after
+		// which it creates the Machine (0 creates it right away)
+		statuses     []int
+		machineName  string
+		wantAttempts int32
+		wantStatus   int
+	}{
+		{"gateway errors until it works", fastRetries(5), []int{502, 503, 504}, "", 4, 0},
+		{"out of attempts", fastRetries(3), []int{503, 503, 503, 503}, "", 3, 503},
+		{"rate limited", fastRetries(5), []int{429}, "", 2, 0},
+		{"conflict on an unnamed machine", fastRetries(5), []int{409}, "", 2, 0},
+		{"conflict on a named machine is final", fastRetries(5), []int{409}, "sched-nightly-1", 1, 409},
+		{"precondition failed", fastRetries(5), []int{412}, "sched-nightly-1", 2, 0},
+		{"bad image", fastRetries(5), []int{422}, "", 1, 422},
+		{"internal server error", fastRetries(5), []int{500}, "", 1, 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+
+			server := flytest.NewServer()
+			server.CreateStatus = func(m *fly.Machine) int {
+				n := attempts.Add(1)
+				if int(n) <= len(tt.statuses) {
+					return tt.statuses[n-1]
+				}
+				return 0
+			}
+			defer server.Close()
+
+			api := fly.NewApi("token", server.URL)
+			api.RetryPolicy = tt.policy
+
+			m, err := api.CreateMachine(context.Background(), &fly.CreateMachineInput{
+				AppName: "lambdo-test",
+				Machine: fly.Machine{
+					Name:   tt.machineName,
+					Config: fly.MachineConfig{Image: "registry.fly.io/app:tag"},
+				},
+			})
+
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("made %d attempts, want %d", got, tt.wantAttempts)
+			}
+
+			if tt.wantStatus == 0 {
+				if err != nil || m == nil {
+					t.Fatalf("expected a Machine, got error %v", err)
+				}
+				return
+			}
+
+			var apiErr *fly.APIError
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.wantStatus {
+				t.Fatalf("expected an APIError with status %d, got %v", tt.wantStatus, err)
+			}
+		})
+	}
+}
+
+func TestCreateMachineStopsRetryingAfterMaxElapsed(t *testing.T) {
+	var attempts atomic.Int32
+
+	server := flytest.NewServer()
+	server.CreateStatus = func(m *fly.Machine) int {
+		attempts.Add(1)
+		return http.StatusServiceUnavailable
+	}
+	defer server.Close()
+
+	api := fly.NewApi("token", server.URL)
+	api.RetryPolicy = &fly.RetryPolicy{
+		MaxAttempts:    1000,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		MaxElapsed:     100 * time.Millisecond,
+	}
+
+	started := time.Now()
+	_, err := api.CreateMachine(context.Background(), &fly.CreateMachineInput{
+		AppName: "lambdo-test",
+		Machine: fly.Machine{Config: fly.MachineConfig{Image: "registry.fly.io/app:tag"}},
+	})
+
+	var apiErr *fly.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected an APIError with status 503, got %v", err)
+	}
+
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("retried for %v, past the 100ms MaxElapsed", elapsed)
+	}
+
+	if n := attempts.Load(); n < 2 || n >= 1000 {
+		t.Errorf("made %d attempts, want more than 1 but fewer than MaxAttempts", n)
+	}
+}
+
+func TestCreateMachineGivesUpWhenCancelled(t *testing.T) {
+	server := flytest.NewServer()
+	server.CreateStatus = func(m *fly.Machine) int {
+		return http.StatusServiceUnavailable
+	}
+	defer server.Close()
+
+	api := fly.NewApi("token", server.URL)
+	api.RetryPolicy = &fly.RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Minute,
+		MaxBackoff:     time.Minute,
+		MaxElapsed:     time.Hour,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := api.CreateMachine(ctx, &fly.CreateMachineInput{
+		AppName: "lambdo-test",
+		Machine: fly.Machine{Config: fly.MachineConfig{Image: "registry.fly.io/app:tag"}},
+	})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context's error, got %v", err)
+	}
+}
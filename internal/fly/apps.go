@@ -1,6 +1,7 @@
 package fly
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,7 +18,7 @@ type CreateAppInput struct {
 
 // CreateApp attempts to create an app, specifically
 // using the Fly Machines API
-func (api *Api) CreateApp(i *CreateAppInput) (*App, error) {
+func (api *Api) CreateApp(ctx context.Context, i *CreateAppInput) (*App, error) {
 	app := i.Name
 	org := i.Org
 
@@ -31,7 +32,7 @@ func (api *Api) CreateApp(i *CreateAppInput) (*App, error) {
 		Network: fmt.Sprintf("%s-net", i.Name),
 	}
 
-	response, err := DoRequest(api.Token, req)
+	response, err := api.DoRequest(ctx, req)
 
 	if err != nil {
 		return nil, fmt.Errorf("request error: %w", err)
@@ -39,7 +40,7 @@ func (api *Api) CreateApp(i *CreateAppInput) (*App, error) {
 	defer response.Body.Close()
 
 	if response.StatusCode > 299 {
-		return nil, fmt.Errorf("could not create app, status: %d", response.StatusCode)
+		return nil, newAPIError("create app", response)
 	}
 
 	return &App{
@@ -48,8 +49,6 @@ func (api *Api) CreateApp(i *CreateAppInput) (*App, error) {
 			Slug: org,
 		},
 	}, nil
-
-	return nil, nil
 }
 
 type GetAppInput struct {
@@ -59,14 +58,14 @@ type GetAppInput struct {
 // GetApp attempts to retrieve an application.
 //
 // An app that is not found returns an AppNotFoundError error
-func (api *Api) GetApp(i *GetAppInput) (*App, error) {
+func (api *Api) GetApp(ctx context.Context, i *GetAppInput) (*App, error) {
 	req := &GetAppRequest{
 		App: App{
 			Name: i.Name,
 		},
 	}
 
-	response, err := DoRequest(api.Token, req)
+	response, err := api.DoRequest(ctx, req)
 
 	if err != nil {
 		return nil, fmt.Errorf("request error: %w", err)
@@ -76,13 +75,13 @@ func (api *Api) GetApp(i *GetAppInput) (*App, error) {
 	if response.StatusCode == http.StatusNotFound {
 		return nil, AppNotFoundError{
 			App: i.Name,
-			Err: fmt.Errorf("fly returned 404 for app: %s", i.Name),
+			Err: newAPIError("get app", response),
 		}
 	}
 
 	// Other errors
 	if response.StatusCode > 299 {
-		return nil, fmt.Errorf("could not get app, status: %d", response.StatusCode)
+		return nil, newAPIError("get app", response)
 	}
 
 	responseBody, err := io.ReadAll(response.Body)
@@ -92,10 +91,6 @@ func (api *Api) GetApp(i *GetAppInput) (*App, error) {
 	}
 
 	b := string(responseBody)
-	if response.StatusCode > 399 {
-		return nil, fmt.Errorf("invalid HTTP response '%d': %s", b)
-	}
-
 	logging.GetLogger().Debug("GetApp response", zap.String("body", b))
 
 	a := &App{}
@@ -114,14 +109,14 @@ type DeleteAppInput struct {
 
 // DeleteApp deletes an application and
 // any created Machines
-func (api *Api) DeleteApp(i *DeleteAppInput) error {
+func (api *Api) DeleteApp(ctx context.Context, i *DeleteAppInput) error {
 	req := &DeleteAppRequest{
 		App: App{
 			Name: i.Name,
 		},
 	}
 
-	response, err := DoRequest(api.Token, req)
+	response, err := api.DoRequest(ctx, req)
 
 	if err != nil {
 		return fmt.Errorf("request error: %w", err)
@@ -129,9 +124,8 @@ func (api *Api) DeleteApp(i *DeleteAppInput) error {
 
 	defer response.Body.Close()
 
-	// Log "error" http responses, but otherwise ignore errors here
 	if response.StatusCode > 299 {
-		logging.GetLogger().Error("could not delete app", zap.Int("status", response.StatusCode))
+		return newAPIError("delete app", response)
 	}
 
 	return nil
@@ -140,13 +134,13 @@ func (api *Api) DeleteApp(i *DeleteAppInput) error {
 // FindCreateApp will return an app if it already exists
 // or attempts to create the app if the given app does
 // not yet exist
-func (api *Api) FindCreateApp(i *CreateAppInput) (*App, error) {
+func (api *Api) FindCreateApp(ctx context.Context, i *CreateAppInput) (*App, error) {
 	var app *App
 	var err error
 	var appNotFoundError AppNotFoundError
-	if app, err = api.GetApp(&GetAppInput{i.Name}); err != nil {
+	if app, err = api.GetApp(ctx, &GetAppInput{i.Name}); err != nil {
 		if errors.As(err, &appNotFoundError) {
-			app, err = api.CreateApp(i)
+			app, err = api.CreateApp(ctx, i)
 		} else {
 			return nil, err
 		}
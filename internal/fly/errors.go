@@ -1,6 +1,11 @@
 package fly
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
 
 type AppNotFoundError struct {
 	App string
@@ -11,6 +16,10 @@ func (e AppNotFoundError) Error() string {
 	return fmt.Sprintf("app '%s' not found: %v", e.App, e.Err)
 }
 
+func (e AppNotFoundError) Unwrap() error {
+	return e.Err
+}
+
 type MachineNotFoundError struct {
 	App     string
 	Machine string
@@ -20,3 +29,94 @@ type MachineNotFoundError struct {
 func (e MachineNotFoundError) Error() string {
 	return fmt.Sprintf("app '%s' machine '%s' not found: %v", e.App, e.Machine, e.Err)
 }
+
+func (e MachineNotFoundError) Unwrap() error {
+	return e.Err
+}
+
+type MachineWaitTimeoutError struct {
+	Machine string
+	State   string
+}
+
+func (e MachineWaitTimeoutError) Error() string {
+	return fmt.Sprintf("machine '%s' did not reach state '%s' in time", e.Machine, e.State)
+}
+
+// APIError is an unsuccessful response from the Fly Machines API
+type APIError struct {
+	// Op is what we were trying to do, e.g. "create machine"
+	Op         string
+	StatusCode int
+	// Message is the error Fly returned, or the raw response body
+	Message string
+	// RequestId is Fly's ID for the request, handy for support tickets
+	RequestId string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("could not %s, http status: %d", e.Op, e.StatusCode)
+
+	if len(e.Message) > 0 {
+		msg += fmt.Sprintf(", error: %s", e.Message)
+	}
+
+	if len(e.RequestId) > 0 {
+		msg += fmt.Sprintf(", request id: %s", e.RequestId)
+	}
+
+	return msg
+}
+
+// Retryable is true if the same request may succeed if tried
+// again later, or elsewhere (e.g. in another region). Errors
+// like a bad image or invalid config are not retryable.
+func (e *APIError) Retryable() bool {
+	switch {
+	case e.StatusCode == http.StatusRequestTimeout,
+		e.StatusCode == http.StatusTooManyRequests,
+		e.StatusCode >= 500:
+		return true
+	}
+
+	return e.IsCapacityError()
+}
+
+// IsCapacityError is true if Fly could not find room for
+// the Machine, which usually means trying another region
+func (e *APIError) IsCapacityError() bool {
+	msg := strings.ToLower(e.Message)
+
+	for _, hint := range []string{"capacity", "insufficient", "could not reserve resource", "no host"} {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newAPIError builds an APIError from an unsuccessful response,
+// reading (but not closing) the response body
+func newAPIError(op string, response *http.Response) *APIError {
+	e := &APIError{
+		Op:         op,
+		StatusCode: response.StatusCode,
+		RequestId:  response.Header.Get("fly-request-id"),
+	}
+
+	body := strings.TrimSpace(readErrorBody(response))
+
+	// Fly errors usually look like {"error": "..."}
+	flyError := struct {
+		Error string `json:"error"`
+	}{}
+
+	if err := json.Unmarshal([]byte(body), &flyError); err == nil && len(flyError.Error) > 0 {
+		e.Message = flyError.Error
+	} else {
+		e.Message = body
+	}
+
+	return e
+}
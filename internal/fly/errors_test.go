@@ -0,0 +1,74 @@
+package fly
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAPIErrorClassification(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		message   string
+		retryable bool
+		capacity  bool
+	}{
+		{"request timeout", http.StatusRequestTimeout, "", true, false},
+		{"rate limited", http.StatusTooManyRequests, "rate limit exceeded", true, false},
+		{"internal server error", http.StatusInternalServerError, "", true, false},
+		{"service unavailable", http.StatusServiceUnavailable, "", true, false},
+		{"no capacity", http.StatusUnprocessableEntity, "no capacity available in ams", true, true},
+		{"insufficient resources", http.StatusPreconditionFailed, "Insufficient memory available to fulfill request", true, true},
+		{"could not reserve resource", http.StatusUnprocessableEntity, "could not reserve resource for machine: out of cpus", true, true},
+		{"no host", http.StatusUnprocessableEntity, "No host available", true, true},
+		{"bad image", http.StatusUnprocessableEntity, "invalid image identifier", false, false},
+		{"bad request", http.StatusBadRequest, "invalid config.guest.cpus", false, false},
+		{"unauthorized", http.StatusUnauthorized, "unauthorized", false, false},
+		{"not found", http.StatusNotFound, "app not found", false, false},
+		{"named machine exists", http.StatusConflict, "a machine with this name already exists", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &APIError{Op: "create machine", StatusCode: tt.status, Message: tt.message}
+
+			if got := e.Retryable(); got != tt.retryable {
+				t.Errorf("Retryable() = %t, want %t", got, tt.retryable)
+			}
+
+			if got := e.IsCapacityError(); got != tt.capacity {
+				t.Errorf("IsCapacityError() = %t, want %t", got, tt.capacity)
+			}
+		})
+	}
+}
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantMessage string
+	}{
+		{"fly error", `{"error": "invalid image identifier"}`, "invalid image identifier"},
+		{"other json", `{"status": "bad"}`, `{"status": "bad"}`},
+		{"plain text", "  upstream connect error\n", "upstream connect error"},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := &http.Response{
+				StatusCode: http.StatusUnprocessableEntity,
+				Header:     http.Header{"Fly-Request-Id": []string{"01HREQ"}},
+				Body:       io.NopCloser(strings.NewReader(tt.body)),
+			}
+
+			e := newAPIError("create machine", response)
+			if e.StatusCode != http.StatusUnprocessableEntity || e.Message != tt.wantMessage || e.RequestId != "01HREQ" {
+				t.Errorf("newAPIError() = %+v, want message %q", e, tt.wantMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,461 @@
+// Package flytest provides a fake, in-memory Fly Machines API,
+// so lambdo can be run end-to-end without talking to Fly
+package flytest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/superfly/lambdo/internal/fly"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a fake Fly Machines API. Machines move through the same
+// states as real ones (created, starting, started, stopping, stopped,
+// destroying, destroyed), just faster. Set any options before
+// making requests to it.
+type Server struct {
+	*httptest.Server
+
+	// Token, if set, must be sent as the Bearer token of every request
+	Token string
+
+	// StartDelay is how long a Machine takes to start
+	StartDelay time.Duration
+
+	// RunDuration is how long a started Machine runs before it exits
+	RunDuration time.Duration
+
+	// ExitCode returns the exit code of a Machine's run, 0 if not set
+	ExitCode func(m *fly.Machine) int
+
+	// CreateStatus returns an HTTP status code to fail CreateMachine
+	// with (e.g. to simulate a region without capacity), or 0 to let
+	// the Machine be created
+	CreateStatus func(m *fly.Machine) int
+
+	mu       sync.Mutex
+	machines map[string]*machine
+}
+
+type machine struct {
+	fly.Machine
+	app string
+
+	// generation is bumped every time the Machine is (re)launched
+	// or stopped, so stale state transitions can be dropped
+	generation int
+
+	// changed is closed (and replaced) on every state change
+	changed chan struct{}
+}
+
+// NewServer starts a fake Fly Machines API. Point
+// a fly.Api at its URL to use it.
+func NewServer() *Server {
+	s := &Server{
+		StartDelay:  50 * time.Millisecond,
+		RunDuration: 200 * time.Millisecond,
+		machines:    map[string]*machine{},
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.route))
+
+	return s
+}
+
+// Machines returns a copy of every Machine the server knows
+// about, including destroyed ones
+func (s *Server) Machines() []fly.Machine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	machines := make([]fly.Machine, 0, len(s.machines))
+	for _, m := range s.machines {
+		machines = append(machines, m.Machine)
+	}
+
+	return machines
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	if len(s.Token) > 0 && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	// /v1/apps/{app}/machines[/{id}[/{action}]]
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "v1" || parts[1] != "apps" || parts[3] != "machines" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	app := parts[2]
+
+	switch {
+	case len(parts) == 4 && r.Method == http.MethodGet:
+		s.list(w, app)
+	case len(parts) == 4 && r.Method == http.MethodPost:
+		s.create(w, r, app)
+	case len(parts) == 5 && r.Method == http.MethodGet:
+		s.get(w, app, parts[4])
+	case len(parts) == 5 && r.Method == http.MethodPost:
+		s.update(w, r, app, parts[4])
+	case len(parts) == 5 && r.Method == http.MethodDelete:
+		s.delete(w, r, app, parts[4])
+	case len(parts) == 6 && r.Method == http.MethodPost && parts[5] == "start":
+		s.start(w, app, parts[4])
+	case len(parts) == 6 && r.Method == http.MethodPost && parts[5] == "stop":
+		s.stop(w, app, parts[4])
+	case len(parts) == 6 && r.Method == http.MethodGet && parts[5] == "wait":
+		s.wait(w, r, app, parts[4])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+type machineBody struct {
+	Name       string            `json:"name"`
+	Region     string            `json:"region"`
+	Config     fly.MachineConfig `json:"config"`
+	SkipLaunch bool              `json:"skip_launch"`
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request, app string) {
+	body := &machineBody{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+		return
+	}
+
+	if len(body.Config.Image) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "invalid config.image")
+		return
+	}
+
+	if len(body.Region) == 0 {
+		body.Region = "iad"
+	}
+
+	m := &machine{
+		Machine: fly.Machine{
+			Id:         randomId(7),
+			Name:       body.Name,
+			State:      "created",
+			Region:     body.Region,
+			InstanceId: randomId(13),
+			PrivateIp:  "fdaa::1",
+			Config:     body.Config,
+		},
+		app:     app,
+		changed: make(chan struct{}),
+	}
+
+	if s.CreateStatus != nil {
+		if status := s.CreateStatus(&m.Machine); status > 0 {
+			writeError(w, status, "could not create machine")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.machines {
+		if len(m.Name) > 0 && existing.app == app && existing.Name == m.Name && existing.State != "destroyed" {
+			writeError(w, http.StatusConflict, "a machine with this name already exists")
+			return
+		}
+	}
+
+	if len(m.Name) == 0 {
+		m.Name = "machine-" + m.Id
+	}
+
+	s.machines[m.Id] = m
+
+	if !body.SkipLaunch {
+		s.launch(m)
+	}
+
+	writeJson(w, http.StatusOK, &m.Machine)
+}
+
+func (s *Server) get(w http.ResponseWriter, app, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.find(w, app, id)
+	if !ok {
+		return
+	}
+
+	writeJson(w, http.StatusOK, &m.Machine)
+}
+
+func (s *Server) list(w http.ResponseWriter, app string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	machines := []fly.Machine{}
+	for _, m := range s.machines {
+		if m.app == app && m.State != "destroyed" {
+			machines = append(machines, m.Machine)
+		}
+	}
+
+	writeJson(w, http.StatusOK, machines)
+}
+
+func (s *Server) update(w http.ResponseWriter, r *http.Request, app, id string) {
+	body := &machineBody{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.find(w, app, id)
+	if !ok {
+		return
+	}
+
+	if m.State == "destroyed" || m.State == "destroying" {
+		writeError(w, http.StatusPreconditionFailed, "machine is "+m.State)
+		return
+	}
+
+	wasRunning := m.State != "stopped" && m.State != "created"
+
+	m.Config = body.Config
+	m.InstanceId = randomId(13)
+	if len(body.Region) > 0 {
+		m.Region = body.Region
+	}
+
+	// Like Fly, updating a running Machine restarts it, and a
+	// stopped one is started unless told otherwise
+	if wasRunning || !body.SkipLaunch {
+		s.launch(m)
+	} else {
+		s.setState(m, m.State)
+	}
+
+	writeJson(w, http.StatusOK, &m.Machine)
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, app, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.find(w, app, id)
+	if !ok {
+		return
+	}
+
+	if m.State != "stopped" && m.State != "created" && r.URL.Query().Get("kill") != "true" {
+		writeError(w, http.StatusPreconditionFailed, "machine still active, refusing to delete")
+		return
+	}
+
+	m.generation++
+	s.setState(m, "destroyed")
+
+	writeJson(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func (s *Server) start(w http.ResponseWriter, app, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.find(w, app, id)
+	if !ok {
+		return
+	}
+
+	previous := m.State
+	if previous == "stopped" || previous == "created" {
+		s.launch(m)
+	}
+
+	writeJson(w, http.StatusOK, map[string]string{"previous_state": previous})
+}
+
+func (s *Server) stop(w http.ResponseWriter, app, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.find(w, app, id)
+	if !ok {
+		return
+	}
+
+	if m.State == "started" || m.State == "starting" {
+		m.generation++
+		s.exit(m, &fly.MachineExitEvent{
+			ExitCode:      0,
+			RequestedStop: true,
+		})
+	}
+
+	writeJson(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func (s *Server) wait(w http.ResponseWriter, r *http.Request, app, id string) {
+	state := r.URL.Query().Get("state")
+	if len(state) == 0 {
+		state = "started"
+	}
+
+	timeout := 60 * time.Second
+	if t, err := time.ParseDuration(r.URL.Query().Get("timeout") + "s"); err == nil {
+		timeout = t
+	}
+
+	deadline := time.After(timeout)
+
+	for {
+		s.mu.Lock()
+		m, ok := s.find(w, app, id)
+		if !ok {
+			s.mu.Unlock()
+			return
+		}
+
+		if m.State == state {
+			s.mu.Unlock()
+			writeJson(w, http.StatusOK, map[string]bool{"ok": true})
+			return
+		}
+
+		if m.State == "destroyed" {
+			s.mu.Unlock()
+			writeError(w, http.StatusBadRequest, "machine is destroyed")
+			return
+		}
+
+		changed := m.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			writeError(w, http.StatusRequestTimeout, "deadline_exceeded: timeout waiting for machine to be "+state)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// find looks up a Machine, writing a 404 response if there is
+// no such Machine. It must be called with the lock held.
+func (s *Server) find(w http.ResponseWriter, app, id string) (*machine, bool) {
+	m, ok := s.machines[id]
+	if !ok || m.app != app {
+		writeError(w, http.StatusNotFound, "machine not found")
+		return nil, false
+	}
+
+	return m, true
+}
+
+// launch starts a Machine, which then runs for RunDuration and exits.
+// It must be called with the lock held.
+func (s *Server) launch(m *machine) {
+	m.generation++
+	generation := m.generation
+
+	s.setState(m, "starting")
+
+	s.after(m, generation, s.StartDelay, func() {
+		s.setState(m, "started")
+
+		s.after(m, generation, s.RunDuration, func() {
+			exitCode := 0
+			if s.ExitCode != nil {
+				exitCode = s.ExitCode(&m.Machine)
+			}
+
+			s.exit(m, &fly.MachineExitEvent{
+				ExitCode: exitCode,
+			})
+		})
+	})
+}
+
+// exit stops a Machine with the given exit event, destroying it if it's
+// set to auto-destroy. It must be called with the lock held.
+func (s *Server) exit(m *machine, exit *fly.MachineExitEvent) {
+	now := time.Now()
+	exit.ExitedAt = now.UTC().Format(time.RFC3339Nano)
+
+	// Fly lists the newest events first
+	m.Events = append([]fly.MachineEvent{
+		{
+			Type:      "exit",
+			Status:    "stopped",
+			Source:    "flyd",
+			Timestamp: now.UnixMilli(),
+			Request: &fly.MachineEventRequest{
+				ExitEvent: exit,
+			},
+		},
+	}, m.Events...)
+
+	s.setState(m, "stopped")
+
+	if m.Config.AutoDestroy {
+		generation := m.generation
+		s.setState(m, "destroying")
+		s.after(m, generation, s.StartDelay, func() {
+			s.setState(m, "destroyed")
+		})
+	}
+}
+
+// after runs f (with the lock held) once d has passed, unless the
+// Machine was relaunched, stopped or destroyed in the meantime
+func (s *Server) after(m *machine, generation int, d time.Duration, f func()) {
+	time.AfterFunc(d, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if m.generation != generation || m.State == "destroyed" {
+			return
+		}
+
+		f()
+	})
+}
+
+// setState must be called with the lock held
+func (s *Server) setState(m *machine, state string) {
+	m.State = state
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"error": message})
+}
+
+func randomId(bytes int) string {
+	b := make([]byte, bytes)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
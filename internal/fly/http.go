@@ -1,12 +1,16 @@
 package fly
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/metrics"
 	"go.uber.org/zap"
+	"io"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,7 +21,7 @@ var client = &http.Client{
 // FlyRequest is an interface for API requests made to
 // the Fly Machines API
 type FlyRequest interface {
-	ToRequest(token string) (*http.Request, error)
+	ToRequest(ctx context.Context, baseUrl, token string) (*http.Request, error)
 }
 
 // StandardRequestHeaders adds standard request headers for Fly API
@@ -28,115 +32,149 @@ func StandardRequestHeaders(req *http.Request, token string) {
 	req.Header.Set("Accept", "application/json")
 }
 
-// DoRequest runs an HTTP request, retrying any that time out
-// due to possible "instability" in the Fly Machines API
-func DoRequest(token string, r FlyRequest) (*http.Response, error) {
+// readErrorBody reads the body of an unsuccessful response,
+// which usually explains what Fly did not like about a request
+func readErrorBody(response *http.Response) string {
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Sprintf("error (response body reading): %s", err)
+	}
+
+	return string(responseBody)
+}
+
+// DoRequest runs an HTTP request, retrying any that time out, are
+// rate limited or hit a gateway error, due to possible "instability"
+// in the Fly Machines API. Cancelling the context aborts the request
+// and any retries.
+func (api *Api) DoRequest(ctx context.Context, r FlyRequest) (*http.Response, error) {
 	defer func() {
 		if r := recover(); r != nil {
 			logging.GetLogger().Error("DoRequest panic", zap.Any("maybe-error", r))
 		}
 	}()
 
-	req, err := r.ToRequest(token)
-	if err != nil {
-		return nil, fmt.Errorf("could not create request: %w", err)
-	}
-
-	result, err := doRequestWithRetries(req)
+	result, err := api.doRequestWithRetries(ctx, r)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: Result should never be nil here
-	if result != nil && result.StatusCode > 299 {
+	if result.StatusCode > 299 {
 		logging.GetLogger().Error(
 			"API request to Fly returned unsuccessful status",
 			zap.Int("status", result.StatusCode),
-			zap.String("method", req.Method),
-			zap.String("url", req.URL.String()),
+			zap.String("method", result.Request.Method),
+			zap.String("url", result.Request.URL.String()),
 		)
 	}
 
 	return result, nil
 }
 
-func doRequestWithRetries(req *http.Request) (*http.Response, error) {
-	defer func() {
-		if r := recover(); r != nil {
-			logging.GetLogger().Error("doRequestWithRetries panic", zap.Any("maybe-error", r))
-		}
-	}()
+func (api *Api) doRequestWithRetries(ctx context.Context, r FlyRequest) (*http.Response, error) {
+	policy := api.RetryPolicy
+	if policy == nil {
+		policy = DefaultRetryPolicy()
+	}
+
+	started := time.Now()
 
 	var result *http.Response
 	var err error
-	for attempts := 1; attempts <= 5; attempts++ {
+	for attempts := 1; ; attempts++ {
+		// A request body can only be read once, so
+		// every attempt gets a brand new request
+		req, reqErr := r.ToRequest(ctx, api.BaseUrl, api.Token)
+		if reqErr != nil {
+			return nil, fmt.Errorf("could not create request: %w", reqErr)
+		}
+
 		logging.GetLogger().Debug(
 			"making API request to Fly",
 			zap.Int("attempt", attempts),
 			zap.String("method", req.Method),
 			zap.String("url", req.URL.String()),
 		)
+
 		result, err = client.Do(req)
+		metrics.FlyRequests.WithLabelValues(req.Method, requestStatus(result, err)).Inc()
+
 		if err != nil {
-			if os.IsTimeout(err) {
-				// Log body if available
-				body := "nil"
-				reqBody, reqBodyErr := req.GetBody()
-				if reqBodyErr == nil {
-					buf := new(bytes.Buffer)
-					buf.ReadFrom(reqBody)
-					body = buf.String()
-				}
-
-				logging.GetLogger().Debug("client timeout, retrying soon", zap.String("method", req.Method), zap.String("url", req.URL.String()), zap.String("body", body))
-				time.Sleep(time.Second * 1)
-				continue
+			// If it's not a timeout (or we were cancelled), break out and return the error
+			if !os.IsTimeout(err) || ctx.Err() != nil {
+				return nil, fmt.Errorf("http client error: %w", err)
 			}
 
-			// If it's not a timeout, break out and return the error
-			return nil, fmt.Errorf("http client error: %w", err)
-		}
+			logging.GetLogger().Debug("client timeout", zap.String("method", req.Method), zap.String("url", req.URL.String()))
+		} else if retryableResponse(r, result.StatusCode) {
+			logging.GetLogger().Debug("retryable response", zap.Int("status", result.StatusCode), zap.String("method", req.Method), zap.String("url", req.URL.String()))
+		} else {
+			// 400 (bad request), preferably we know what exactly is wrong
+			if result.StatusCode == http.StatusBadRequest {
+				body := readErrorBody(result)
+				logging.GetLogger().Debug("bad request response", zap.String("method", req.Method), zap.String("url", req.URL.String()), zap.String("body", body))
+
+				// Put the body back for the caller
+				result.Body = io.NopCloser(strings.NewReader(body))
+			}
 
-		// Deleting a machine may result in a 409 response
-		// (even with the force flag)
-		// TODO: Result should never be nil here
-		if result != nil && result.StatusCode == http.StatusConflict {
-			logging.GetLogger().Debug("conflict response, retrying soon", zap.String("method", req.Method), zap.String("url", req.URL.String()))
-			time.Sleep(time.Second * 2)
-			continue
+			logging.GetLogger().Debug(
+				"made API request to Fly",
+				zap.Int("attempt", attempts),
+				zap.String("method", req.Method),
+				zap.String("url", req.URL.String()),
+				zap.Int("status", result.StatusCode),
+			)
+			return result, nil
 		}
 
-		// Deleting a machine may result in a 412 response
-		// (even with the force flag)
-		// TODO: Result should never be nil here
-		if result != nil && result.StatusCode == http.StatusPreconditionFailed {
-			logging.GetLogger().Debug("precondition failed response, retrying soon", zap.String("method", req.Method), zap.String("url", req.URL.String()))
-			time.Sleep(time.Second * 2)
-			continue
+		wait := policy.wait(attempts, result)
+		if attempts >= policy.MaxAttempts || time.Since(started)+wait > policy.MaxElapsed {
+			logging.GetLogger().Debug("giving up on API request to Fly", zap.Int("attempts", attempts), zap.Duration("elapsed", time.Since(started)))
+			break
 		}
 
-		// 400 (bad request), preferably we know what exactly is wrong
-		if result != nil && result.StatusCode == http.StatusBadRequest {
-			// Log body if available
-			body := "nil"
-			buf := new(bytes.Buffer)
-			_, bodyErr := buf.ReadFrom(result.Body)
-			if bodyErr == nil {
-				body = buf.String()
-			}
+		// We're not going to use this response
+		if result != nil {
+			result.Body.Close()
+		}
 
-			logging.GetLogger().Debug("bad request response", zap.String("method", req.Method), zap.String("url", req.URL.String()), zap.String("body", body))
+		logging.GetLogger().Debug("retrying API request to Fly soon", zap.Duration("wait", wait))
+		metrics.FlyRetries.WithLabelValues(req.Method).Inc()
+		if sleepErr := sleep(ctx, wait); sleepErr != nil {
+			return nil, sleepErr
 		}
+	}
 
-		logging.GetLogger().Debug(
-			"made API request to Fly",
-			zap.Int("attempt", attempts),
-			zap.String("method", req.Method),
-			zap.String("url", req.URL.String()),
-			zap.Int("status", result.StatusCode),
-		)
+	// Out of retries. The last response (if we got one)
+	// tells the caller what went wrong
+	if result != nil {
 		return result, nil
 	}
 
-	return nil, err
+	return nil, fmt.Errorf("http client error: %w", err)
+}
+
+// requestStatus labels the outcome of a request
+// with its status code, or "error" if it has none
+func requestStatus(response *http.Response, err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return strconv.Itoa(response.StatusCode)
+}
+
+// sleep waits for the given duration, returning
+// early if the context is cancelled
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -1,7 +1,9 @@
 package fly
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/superfly/lambdo/internal/logging"
 	"go.uber.org/zap"
@@ -15,7 +17,7 @@ type CreateMachineInput struct {
 	Machine Machine
 }
 
-func (api *Api) CreateMachine(i *CreateMachineInput) (*Machine, error) {
+func (api *Api) CreateMachine(ctx context.Context, i *CreateMachineInput) (*Machine, error) {
 	req := &CreateMachineRequest{
 		App: App{
 			Name: i.AppName,
@@ -23,7 +25,7 @@ func (api *Api) CreateMachine(i *CreateMachineInput) (*Machine, error) {
 		Machine: i.Machine,
 	}
 
-	response, err := DoRequest(api.Token, req)
+	response, err := api.DoRequest(ctx, req)
 
 	if err != nil {
 		return nil, fmt.Errorf("request error: %w", err)
@@ -31,19 +33,8 @@ func (api *Api) CreateMachine(i *CreateMachineInput) (*Machine, error) {
 	defer response.Body.Close()
 
 	if response.StatusCode > 299 {
-		// Special handling for 422 error where Fly does not like our request
-		if response.StatusCode == http.StatusUnprocessableEntity {
-			loggedResponseBody := "no value yet"
-			responseBody, err := io.ReadAll(response.Body)
-			if err != nil {
-				loggedResponseBody = fmt.Sprintf("error (response body reading): %s", err)
-			} else {
-				loggedResponseBody = string(responseBody)
-			}
-			return nil, fmt.Errorf("did not create machine, http status: %d, http body: %s", response.StatusCode, loggedResponseBody)
-		} else {
-			return nil, fmt.Errorf("did not create machine, http status: %d", response.StatusCode)
-		}
+		// The body tells us why, e.g. a 422 when Fly does not like our request
+		return nil, newAPIError("create machine", response)
 	}
 
 	responseBody, err := io.ReadAll(response.Body)
@@ -67,7 +58,7 @@ type GetMachineInput struct {
 	MachineId string
 }
 
-func (api *Api) GetMachine(i *GetMachineInput) (*Machine, error) {
+func (api *Api) GetMachine(ctx context.Context, i *GetMachineInput) (*Machine, error) {
 	req := &GetMachineRequest{
 		App: App{
 			Name: i.AppName,
@@ -77,7 +68,7 @@ func (api *Api) GetMachine(i *GetMachineInput) (*Machine, error) {
 		},
 	}
 
-	response, err := DoRequest(api.Token, req)
+	response, err := api.DoRequest(ctx, req)
 
 	if err != nil {
 		return nil, fmt.Errorf("request error: %w", err)
@@ -89,26 +80,22 @@ func (api *Api) GetMachine(i *GetMachineInput) (*Machine, error) {
 		return nil, MachineNotFoundError{
 			App:     i.AppName,
 			Machine: i.MachineId,
-			Err:     err,
+			Err:     newAPIError("get machine", response),
 		}
 	}
 
 	// Other errors
 	if response.StatusCode > 299 {
-		return nil, fmt.Errorf("could not get machine, http status: %d", response.StatusCode)
+		return nil, newAPIError("get machine", response)
 	}
 
 	responseBody, err := io.ReadAll(response.Body)
 
-	b := string(responseBody)
-	if response.StatusCode > 399 {
-		return nil, fmt.Errorf("invalid HTTP response '%d': %s", b)
-	}
-
 	if err != nil {
 		return nil, fmt.Errorf("response body reading error: %w", err)
 	}
 
+	b := string(responseBody)
 	logging.GetLogger().Debug("GetMachine response", zap.String("body", b))
 
 	m := &Machine{}
@@ -125,14 +112,14 @@ type ListMachinesInput struct {
 	AppName string
 }
 
-func (api *Api) ListMachines(i *ListMachinesInput) (*ListMachinesResponse, error) {
+func (api *Api) ListMachines(ctx context.Context, i *ListMachinesInput) (*ListMachinesResponse, error) {
 	req := &ListMachinesRequest{
 		App: App{
 			Name: i.AppName,
 		},
 	}
 
-	response, err := DoRequest(api.Token, req)
+	response, err := api.DoRequest(ctx, req)
 
 	if err != nil {
 		return nil, fmt.Errorf("request error: %w", err)
@@ -140,7 +127,7 @@ func (api *Api) ListMachines(i *ListMachinesInput) (*ListMachinesResponse, error
 	defer response.Body.Close()
 
 	if response.StatusCode > 299 {
-		return nil, fmt.Errorf("could not list machines, http status: %d", response.StatusCode)
+		return nil, newAPIError("list machines", response)
 	}
 
 	responseBody, err := io.ReadAll(response.Body)
@@ -159,16 +146,70 @@ func (api *Api) ListMachines(i *ListMachinesInput) (*ListMachinesResponse, error
 	return m, nil
 }
 
-/* TODO: Implement this. It's similar (equivalent to?)
-         the CreateMachine API call
 type UpdateMachineInput struct {
-
+	AppName   string
+	MachineId string
+	Config    MachineConfig
+	// Region is optional, the Machine stays where it is if not set
+	Region string
+	// SkipLaunch keeps a stopped Machine stopped after it's updated
+	SkipLaunch bool
+	// LeaseNonce is needed to update a Machine that has a lease on it
+	LeaseNonce string
 }
 
-func (api *Api) UpdateMachine() error {
+// UpdateMachine replaces the config of an existing Machine, e.g. to
+// run a new image or events file. A stopped Machine is started once
+// it's updated, unless SkipLaunch is set.
+func (api *Api) UpdateMachine(ctx context.Context, i *UpdateMachineInput) (*Machine, error) {
+	req := &UpdateMachineRequest{
+		App: App{
+			Name: i.AppName,
+		},
+		Machine: Machine{
+			Id:     i.MachineId,
+			Region: i.Region,
+			Config: i.Config,
+		},
+		SkipLaunch: i.SkipLaunch,
+		LeaseNonce: i.LeaseNonce,
+	}
+
+	response, err := api.DoRequest(ctx, req)
+
+	if err != nil {
+		return nil, fmt.Errorf("request error: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, MachineNotFoundError{
+			App:     i.AppName,
+			Machine: i.MachineId,
+			Err:     newAPIError("update machine", response),
+		}
+	}
+
+	// The body tells us why, e.g. a 422 when Fly does not like our request
+	if response.StatusCode > 299 {
+		return nil, newAPIError("update machine", response)
+	}
 
+	responseBody, err := io.ReadAll(response.Body)
+
+	if err != nil {
+		return nil, fmt.Errorf("response body reading error: %w", err)
+	}
+
+	m := &Machine{}
+	err = json.Unmarshal(responseBody, m)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshall json: %w", err)
+	}
+
+	return m, nil
 }
-*/
 
 type DeleteMachineInput struct {
 	AppName   string
@@ -176,7 +217,7 @@ type DeleteMachineInput struct {
 	Force     bool
 }
 
-func (api *Api) DeleteMachine(i *DeleteMachineInput) error {
+func (api *Api) DeleteMachine(ctx context.Context, i *DeleteMachineInput) error {
 	req := &DeleteMachineRequest{
 		App: App{
 			Name: i.AppName,
@@ -187,19 +228,15 @@ func (api *Api) DeleteMachine(i *DeleteMachineInput) error {
 		Force: i.Force,
 	}
 
-	response, err := DoRequest(api.Token, req)
+	response, err := api.DoRequest(ctx, req)
 
 	if err != nil {
 		return fmt.Errorf("request error: %w", err)
 	}
+	defer response.Body.Close()
 
-	if response != nil {
-		// Log "error" http responses, but otherwise ignore errors here
-		if response.StatusCode > 299 {
-			logging.GetLogger().Error("could not delete machine", zap.Int("status", response.StatusCode))
-		}
-	} else {
-		logging.GetLogger().Error("Delete Machine: We should have a response object here, but we do not")
+	if response.StatusCode > 299 {
+		return newAPIError("delete machine", response)
 	}
 
 	return nil
@@ -210,7 +247,7 @@ type StartMachineInput struct {
 	MachineId string
 }
 
-func (api *Api) StartMachine(i *StartMachineInput) error {
+func (api *Api) StartMachine(ctx context.Context, i *StartMachineInput) error {
 	req := &StartMachineRequest{
 		App: App{
 			Name: i.AppName,
@@ -220,11 +257,16 @@ func (api *Api) StartMachine(i *StartMachineInput) error {
 		},
 	}
 
-	_, err := DoRequest(api.Token, req)
+	response, err := api.DoRequest(ctx, req)
 
 	if err != nil {
 		return fmt.Errorf("request error: %w", err)
 	}
+	defer response.Body.Close()
+
+	if response.StatusCode > 299 {
+		return newAPIError("start machine", response)
+	}
 
 	return nil
 }
@@ -234,7 +276,7 @@ type StopMachineInput struct {
 	MachineId string
 }
 
-func (api *Api) StopMachine(i *StopMachineInput) error {
+func (api *Api) StopMachine(ctx context.Context, i *StopMachineInput) error {
 	req := &StopMachineRequest{
 		App: App{
 			Name: i.AppName,
@@ -244,18 +286,136 @@ func (api *Api) StopMachine(i *StopMachineInput) error {
 		},
 	}
 
-	_, err := DoRequest(api.Token, req)
+	response, err := api.DoRequest(ctx, req)
 
 	if err != nil {
 		return fmt.Errorf("request error: %w", err)
 	}
+	defer response.Body.Close()
+
+	if response.StatusCode > 299 {
+		return newAPIError("stop machine", response)
+	}
 
 	return nil
 }
 
+type WaitForMachineStateInput struct {
+	AppName    string
+	MachineId  string
+	InstanceId string
+	State      string
+	// Timeout in seconds, Fly allows a max of 60
+	Timeout int
+}
+
+// WaitForMachineState uses the Machines wait endpoint to block
+// until the Machine reaches the given state. A Machine that
+// did not reach the state before the timeout returns
+// a MachineWaitTimeoutError error
+func (api *Api) WaitForMachineState(ctx context.Context, i *WaitForMachineStateInput) error {
+	req := &WaitMachineRequest{
+		App: App{
+			Name: i.AppName,
+		},
+		Machine: Machine{
+			Id:         i.MachineId,
+			InstanceId: i.InstanceId,
+		},
+		State:   i.State,
+		Timeout: i.Timeout,
+	}
+
+	response, err := api.DoRequest(ctx, req)
+
+	if err != nil {
+		return fmt.Errorf("request error: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusRequestTimeout {
+		return MachineWaitTimeoutError{
+			Machine: i.MachineId,
+			State:   i.State,
+		}
+	}
+
+	if response.StatusCode > 299 {
+		return newAPIError("wait for machine", response)
+	}
+
+	return nil
+}
+
+type WaitForMachineExitInput struct {
+	AppName    string
+	MachineId  string
+	InstanceId string
+	// MaxWait is the total time to wait for the Machine to exit
+	MaxWait time.Duration
+	// After ignores older exit events, for Machines that ran before
+	After time.Time
+}
+
+// WaitForMachineExit waits for a Machine to stop running
+// (or be destroyed) and returns the resulting exit event
+func (api *Api) WaitForMachineExit(ctx context.Context, i *WaitForMachineExitInput) (*MachineExitEvent, error) {
+	deadline := time.Now().Add(i.MaxWait)
+
+	for time.Now().Before(deadline) {
+		// The wait endpoint may fail if the Machine was auto-destroyed
+		// before we started waiting, so we always double-check the
+		// Machine state via GetMachine
+		waitErr := api.WaitForMachineState(ctx, &WaitForMachineStateInput{
+			AppName:    i.AppName,
+			MachineId:  i.MachineId,
+			InstanceId: i.InstanceId,
+			State:      "stopped",
+			Timeout:    5, // Keep this below the http client timeout
+		})
+
+		var timeoutErr MachineWaitTimeoutError
+		if waitErr != nil && !errors.As(waitErr, &timeoutErr) {
+			logging.GetLogger().Debug("could not wait for machine, checking its state", zap.Error(waitErr), zap.String("machine-id", i.MachineId))
+		}
+
+		m, err := api.GetMachine(ctx, &GetMachineInput{
+			AppName:   i.AppName,
+			MachineId: i.MachineId,
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("could not get machine: %w", err)
+		}
+
+		var exit *MachineExitEvent
+		if m.IsFinished() {
+			exit = m.ExitEventAfter(i.After)
+			if exit != nil {
+				return exit, nil
+			}
+
+			// A destroyed Machine won't ever exit again
+			if m.State != "stopped" {
+				return nil, fmt.Errorf("machine %s is %s but has no exit event", i.MachineId, m.State)
+			}
+		}
+
+		// Don't hammer the API if the wait endpoint is failing, or if
+		// a re-used Machine is still stopped from its previous run
+		if (waitErr != nil && !errors.As(waitErr, &timeoutErr)) || m.IsFinished() {
+			if err := sleep(ctx, 2*time.Second); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("machine %s did not exit within %s", i.MachineId, i.MaxWait)
+}
+
 // WaitForMachine waits for a newly created Machine
 // to become available
-func (api *Api) WaitForMachine(i *GetMachineInput) error {
+func (api *Api) WaitForMachine(ctx context.Context, i *GetMachineInput) error {
 	// Total wait time ~5 minutes (should only need a minute or 2)
 	ticker := time.NewTicker(2 * time.Second)
 	totalAttempts := 0
@@ -264,7 +424,7 @@ func (api *Api) WaitForMachine(i *GetMachineInput) error {
 	for {
 		select {
 		case <-ticker.C:
-			e, err := api.GetMachine(i)
+			e, err := api.GetMachine(ctx, i)
 			if err != nil {
 				ticker.Stop()
 				return fmt.Errorf("could not get machine: %w", err)
@@ -280,6 +440,9 @@ func (api *Api) WaitForMachine(i *GetMachineInput) error {
 				ticker.Stop()
 				return fmt.Errorf("too many GetMachine attempts")
 			}
+		case <-ctx.Done():
+			ticker.Stop()
+			return ctx.Err()
 		}
 	}
 }
@@ -2,6 +2,7 @@ package fly
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -21,15 +22,15 @@ type CreateAppRequest struct {
 	Network string `json:"network"`
 }
 
-func (r *CreateAppRequest) ToRequest(token string) (*http.Request, error) {
+func (r *CreateAppRequest) ToRequest(ctx context.Context, baseUrl, token string) (*http.Request, error) {
 	j, err := json.Marshal(r)
 
 	if err != nil {
 		return nil, fmt.Errorf("could not encode App to JSON: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/v1/apps", "https://api.machines.dev")
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(j))
+	url := fmt.Sprintf("%s/v1/apps", baseUrl)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(j))
 
 	if err != nil {
 		return nil, fmt.Errorf("could not create http request object: %w", err)
@@ -48,10 +49,10 @@ type GetAppRequest struct {
 	App App
 }
 
-func (r *GetAppRequest) ToRequest(token string) (*http.Request, error) {
-	uri := fmt.Sprintf("%s/v1/apps/%s", "https://api.machines.dev", r.App.Name)
+func (r *GetAppRequest) ToRequest(ctx context.Context, baseUrl, token string) (*http.Request, error) {
+	uri := fmt.Sprintf("%s/v1/apps/%s", baseUrl, r.App.Name)
 
-	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
 
 	if err != nil {
 		return nil, fmt.Errorf("could not create http request object: %w", err)
@@ -70,10 +71,10 @@ type DeleteAppRequest struct {
 	App App
 }
 
-func (r *DeleteAppRequest) ToRequest(token string) (*http.Request, error) {
-	uri := fmt.Sprintf("%s/v1/apps/%s", "https://api.machines.dev", r.App.Name)
+func (r *DeleteAppRequest) ToRequest(ctx context.Context, baseUrl, token string) (*http.Request, error) {
+	uri := fmt.Sprintf("%s/v1/apps/%s", baseUrl, r.App.Name)
 
-	req, err := http.NewRequest(http.MethodDelete, uri, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, uri, nil)
 
 	if err != nil {
 		return nil, fmt.Errorf("could not create http request object: %w", err)
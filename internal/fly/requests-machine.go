@@ -2,11 +2,14 @@ package fly
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/superfly/lambdo/internal/logging"
 	"go.uber.org/zap"
 	"net/http"
+	"net/url"
+	"strconv"
 )
 
 /***********************************
@@ -22,7 +25,13 @@ type CreateMachineRequest struct {
 	Machine Machine
 }
 
-func (r *CreateMachineRequest) ToRequest(token string) (*http.Request, error) {
+// finalConflict is true for named Machines, as a 409 then
+// means a Machine by that name exists already
+func (r *CreateMachineRequest) finalConflict() bool {
+	return len(r.Machine.Name) > 0
+}
+
+func (r *CreateMachineRequest) ToRequest(ctx context.Context, baseUrl, token string) (*http.Request, error) {
 	j, err := json.Marshal(r.Machine)
 
 	if err != nil {
@@ -31,8 +40,8 @@ func (r *CreateMachineRequest) ToRequest(token string) (*http.Request, error) {
 
 	logging.GetLogger().Debug("create machine request", zap.ByteString("body", j))
 
-	uri := fmt.Sprintf("%s/v1/apps/%s/machines", "https://api.machines.dev", r.App.Name)
-	req, err := http.NewRequest(http.MethodPost, uri, bytes.NewBuffer(j))
+	uri := fmt.Sprintf("%s/v1/apps/%s/machines", baseUrl, r.App.Name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewBuffer(j))
 
 	if err != nil {
 		return nil, fmt.Errorf("could not create http request object: %w", err)
@@ -52,10 +61,10 @@ type GetMachineRequest struct {
 	Machine Machine
 }
 
-func (r *GetMachineRequest) ToRequest(token string) (*http.Request, error) {
-	uri := fmt.Sprintf("%s/v1/apps/%s/machines/%s", "https://api.machines.dev", r.App.Name, r.Machine.Id)
+func (r *GetMachineRequest) ToRequest(ctx context.Context, baseUrl, token string) (*http.Request, error) {
+	uri := fmt.Sprintf("%s/v1/apps/%s/machines/%s", baseUrl, r.App.Name, r.Machine.Id)
 
-	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
 
 	if err != nil {
 		return nil, fmt.Errorf("could not create http request object: %w", err)
@@ -78,9 +87,9 @@ type ListMachinesResponse struct {
 	Machines []Machine
 }
 
-func (r *ListMachinesRequest) ToRequest(token string) (*http.Request, error) {
-	uri := fmt.Sprintf("%s/v1/apps/%s/machines", "https://api.machines.dev", r.App.Name)
-	req, err := http.NewRequest(http.MethodGet, uri, nil)
+func (r *ListMachinesRequest) ToRequest(ctx context.Context, baseUrl, token string) (*http.Request, error) {
+	uri := fmt.Sprintf("%s/v1/apps/%s/machines", baseUrl, r.App.Name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
 
 	if err != nil {
 		return nil, fmt.Errorf("could not create http request object: %w", err)
@@ -92,23 +101,68 @@ func (r *ListMachinesRequest) ToRequest(token string) (*http.Request, error) {
 }
 
 /*************************
- * Update Machine Request
+ * Wait Machine Request
 *************************/
 
-type UpdateMachineRequest struct {
+type WaitMachineRequest struct {
 	App     App
 	Machine Machine
+	State   string
+	Timeout int
 }
 
-func (r *UpdateMachineRequest) ToRequest(token string) (*http.Request, error) {
-	j, err := json.Marshal(r.Machine)
+func (r *WaitMachineRequest) ToRequest(ctx context.Context, baseUrl, token string) (*http.Request, error) {
+	params := url.Values{}
+	params.Set("state", r.State)
+	params.Set("timeout", strconv.Itoa(r.Timeout))
+	if len(r.Machine.InstanceId) > 0 {
+		params.Set("instance_id", r.Machine.InstanceId)
+	}
+
+	uri := fmt.Sprintf("%s/v1/apps/%s/machines/%s/wait?%s", baseUrl, r.App.Name, r.Machine.Id, params.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not create http request object: %w", err)
+	}
+
+	StandardRequestHeaders(req, token)
+
+	return req, nil
+}
+
+/*************************
+ * Update Machine Request
+*************************/
+
+type UpdateMachineRequest struct {
+	App        App
+	Machine    Machine
+	SkipLaunch bool
+	LeaseNonce string
+}
+
+type updateMachineBody struct {
+	Config     MachineConfig `json:"config"`
+	Region     string        `json:"region,omitempty"`
+	SkipLaunch bool          `json:"skip_launch,omitempty"`
+}
+
+func (r *UpdateMachineRequest) ToRequest(ctx context.Context, baseUrl, token string) (*http.Request, error) {
+	j, err := json.Marshal(&updateMachineBody{
+		Config:     r.Machine.Config,
+		Region:     r.Machine.Region,
+		SkipLaunch: r.SkipLaunch,
+	})
 
 	if err != nil {
 		return nil, fmt.Errorf("could not encode Machine to JSON: %w", err)
 	}
 
-	uri := fmt.Sprintf("%s/v1/apps/%s/machines/%s", "https://api.machines.dev", r.App.Name, r.Machine.Id)
-	req, err := http.NewRequest(http.MethodPost, uri, bytes.NewBuffer(j))
+	logging.GetLogger().Debug("update machine request", zap.ByteString("body", j))
+
+	uri := fmt.Sprintf("%s/v1/apps/%s/machines/%s", baseUrl, r.App.Name, r.Machine.Id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewBuffer(j))
 
 	if err != nil {
 		return nil, fmt.Errorf("could not create http request object: %w", err)
@@ -116,6 +170,11 @@ func (r *UpdateMachineRequest) ToRequest(token string) (*http.Request, error) {
 
 	StandardRequestHeaders(req, token)
 
+	// Required if the Machine is leased, e.g. by flyctl during a deploy
+	if len(r.LeaseNonce) > 0 {
+		req.Header.Set("fly-machine-lease-nonce", r.LeaseNonce)
+	}
+
 	return req, nil
 }
 
@@ -129,7 +188,7 @@ type DeleteMachineRequest struct {
 	Force   bool
 }
 
-func (r *DeleteMachineRequest) ToRequest(token string) (*http.Request, error) {
+func (r *DeleteMachineRequest) ToRequest(ctx context.Context, baseUrl, token string) (*http.Request, error) {
 	var force string
 	if r.Force {
 		force = "?kill=true"
@@ -137,9 +196,9 @@ func (r *DeleteMachineRequest) ToRequest(token string) (*http.Request, error) {
 		force = ""
 	}
 
-	uri := fmt.Sprintf("%s/v1/apps/%s/machines/%s%s", "https://api.machines.dev", r.App.Name, r.Machine.Id, force)
+	uri := fmt.Sprintf("%s/v1/apps/%s/machines/%s%s", baseUrl, r.App.Name, r.Machine.Id, force)
 
-	req, err := http.NewRequest(http.MethodDelete, uri, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, uri, nil)
 
 	if err != nil {
 		return nil, fmt.Errorf("could not create http request object: %w", err)
@@ -159,9 +218,9 @@ type StartMachineRequest struct {
 	Machine Machine
 }
 
-func (r *StartMachineRequest) ToRequest(token string) (*http.Request, error) {
-	uri := fmt.Sprintf("%s/v1/apps/%s/machines/%s/start", "https://api.machines.dev", r.App.Name, r.Machine.Id)
-	req, err := http.NewRequest(http.MethodPost, uri, nil)
+func (r *StartMachineRequest) ToRequest(ctx context.Context, baseUrl, token string) (*http.Request, error) {
+	uri := fmt.Sprintf("%s/v1/apps/%s/machines/%s/start", baseUrl, r.App.Name, r.Machine.Id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, nil)
 
 	if err != nil {
 		return nil, fmt.Errorf("could not create http request object: %w", err)
@@ -181,9 +240,9 @@ type StopMachineRequest struct {
 	Machine Machine
 }
 
-func (r *StopMachineRequest) ToRequest(token string) (*http.Request, error) {
-	uri := fmt.Sprintf("%s/v1/apps/%s/machines/%s/stop", "https://api.machines.dev", r.App.Name, r.Machine.Id)
-	req, err := http.NewRequest(http.MethodPost, uri, nil)
+func (r *StopMachineRequest) ToRequest(ctx context.Context, baseUrl, token string) (*http.Request, error) {
+	uri := fmt.Sprintf("%s/v1/apps/%s/machines/%s/stop", baseUrl, r.App.Name, r.Machine.Id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, nil)
 
 	if err != nil {
 		return nil, fmt.Errorf("could not create http request object: %w", err)
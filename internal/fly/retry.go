@@ -0,0 +1,121 @@
+package fly
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides which requests to the Fly Machines
+// API are retried, and how long to wait between attempts
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry, doubling
+	// on every following retry up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// MaxElapsed caps the total time spent retrying a request
+	MaxElapsed time.Duration
+}
+
+// DefaultRetryPolicy returns the retry policy used
+// by an Api unless told otherwise
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		MaxElapsed:     60 * time.Second,
+	}
+}
+
+// finalConflicter is implemented by requests for which a 409
+// response is final, rather than a transient state to retry through
+type finalConflicter interface {
+	finalConflict() bool
+}
+
+// retryableResponse returns true for response statuses
+// worth retrying the given request for
+func retryableResponse(r FlyRequest, status int) bool {
+	if fc, ok := r.(finalConflicter); ok && status == http.StatusConflict && fc.finalConflict() {
+		return false
+	}
+
+	return retryableStatus(status)
+}
+
+// retryableStatus returns true for response statuses
+// worth retrying the request for
+func retryableStatus(status int) bool {
+	switch status {
+	// Deleting a machine may result in a 409 or 412
+	// response (even with the force flag)
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return true
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// backoff returns how long to wait before the given retry (starting
+// at 1), using exponential backoff with "full jitter", so a bunch of
+// workers that failed at the same time don't all retry at once
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(d))) + 1
+}
+
+// wait returns how long to wait before retrying after the given
+// response, honoring the Retry-After header of 429 responses
+func (p *RetryPolicy) wait(retry int, response *http.Response) time.Duration {
+	if response != nil && response.StatusCode == http.StatusTooManyRequests {
+		if d, ok := retryAfter(response.Header.Get("Retry-After")); ok {
+			return d
+		}
+	}
+
+	return p.backoff(retry)
+}
+
+// retryAfter parses a Retry-After header, which is
+// either a number of seconds or an HTTP date
+func retryAfter(header string) (time.Duration, bool) {
+	if len(header) == 0 {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+
+	return 0, false
+}
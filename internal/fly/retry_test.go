@@ -0,0 +1,138 @@
+package fly
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"missing", "", 0, false},
+		{"seconds", "3", 3 * time.Second, true},
+		{"zero seconds", "0", 0, true},
+		{"negative seconds", "-1", 0, false},
+		{"garbage", "soon", 0, false},
+		{"past date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := retryAfter(tt.header)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("retryAfter(%q) = %v, %t, want %v, %t", tt.header, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+
+	// HTTP dates only have second precision
+	got, ok := retryAfter(time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat))
+	if !ok || got < 8*time.Second || got > 10*time.Second {
+		t.Errorf("retryAfter(date in 10s) = %v, %t", got, ok)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := &RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+
+	tests := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{10, time.Second},
+	}
+
+	for _, tt := range tests {
+		// Full jitter picks anything up to the cap, so try a few times
+		for i := 0; i < 100; i++ {
+			if got := p.backoff(tt.retry); got <= 0 || got > tt.max {
+				t.Fatalf("backoff(%d) = %v, want between 0 and %v", tt.retry, got, tt.max)
+			}
+		}
+	}
+
+	if got := (&RetryPolicy{}).backoff(1); got != 0 {
+		t.Errorf("backoff without an initial backoff = %v, want 0", got)
+	}
+}
+
+func TestRetryPolicyWait(t *testing.T) {
+	p := &RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+
+	response := func(status int, retryAfter string) *http.Response {
+		r := &http.Response{StatusCode: status, Header: http.Header{}}
+		if len(retryAfter) > 0 {
+			r.Header.Set("Retry-After", retryAfter)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		response *http.Response
+		min, max time.Duration
+	}{
+		{"rate limited with Retry-After", response(http.StatusTooManyRequests, "5"), 5 * time.Second, 5 * time.Second},
+		{"rate limited without Retry-After", response(http.StatusTooManyRequests, ""), 1, 100 * time.Millisecond},
+		{"Retry-After on a gateway error", response(http.StatusServiceUnavailable, "5"), 1, 100 * time.Millisecond},
+		{"no response", nil, 1, 100 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.wait(1, tt.response); got < tt.min || got > tt.max {
+				t.Errorf("wait = %v, want between %v and %v", got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestRetryableResponse(t *testing.T) {
+	named := &CreateMachineRequest{Machine: Machine{Name: "sched-nightly-1700000000"}}
+	unnamed := &CreateMachineRequest{}
+	deletion := &DeleteMachineRequest{Force: true}
+
+	tests := []struct {
+		name    string
+		request FlyRequest
+		status  int
+		want    bool
+	}{
+		{"conflict creating a named machine", named, http.StatusConflict, false},
+		{"conflict creating an unnamed machine", unnamed, http.StatusConflict, true},
+		{"precondition failed creating a named machine", named, http.StatusPreconditionFailed, true},
+		{"conflict deleting a machine", deletion, http.StatusConflict, true},
+		{"precondition failed deleting a machine", deletion, http.StatusPreconditionFailed, true},
+		{"rate limited", unnamed, http.StatusTooManyRequests, true},
+		{"bad gateway", unnamed, http.StatusBadGateway, true},
+		{"service unavailable", unnamed, http.StatusServiceUnavailable, true},
+		{"gateway timeout", unnamed, http.StatusGatewayTimeout, true},
+		{"internal server error", unnamed, http.StatusInternalServerError, false},
+		{"unprocessable entity", unnamed, http.StatusUnprocessableEntity, false},
+		{"ok", unnamed, http.StatusOK, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryableResponse(tt.request, tt.status); got != tt.want {
+				t.Errorf("retryableResponse(%d) = %t, want %t", tt.status, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package fly
 
 import (
+	"fmt"
 	"golang.org/x/exp/slices"
+	"time"
 )
 
 const TypeShared = "shared"
@@ -18,12 +20,14 @@ type App struct {
 }
 
 type Machine struct {
-	Id        string        `json:"id,omitempty"`
-	Name      string        `json:"name,omitempty"`
-	State     string        `json:"state,omitempty"`
-	Region    string        `json:"region"`
-	PrivateIp string        `json:"private_ip,omitempty"`
-	Config    MachineConfig `json:"config"`
+	Id         string         `json:"id,omitempty"`
+	Name       string         `json:"name,omitempty"`
+	State      string         `json:"state,omitempty"`
+	Region     string         `json:"region"`
+	InstanceId string         `json:"instance_id,omitempty"`
+	PrivateIp  string         `json:"private_ip,omitempty"`
+	Config     MachineConfig  `json:"config"`
+	Events     []MachineEvent `json:"events,omitempty"`
 }
 
 // IsInitialized checks the state of the machine to see if it
@@ -35,9 +39,49 @@ func (m *Machine) IsInitialized() bool {
 	return slices.Contains(initValues, m.State)
 }
 
+// IsFinished checks the state of the machine to see if
+// it has stopped running (and possibly been destroyed)
+func (m *Machine) IsFinished() bool {
+	finishedValues := []string{"stopped", "destroying", "destroyed"}
+
+	return slices.Contains(finishedValues, m.State)
+}
+
+// ExitEvent returns the most recent exit event of the
+// machine, or nil if the machine has not exited
+func (m *Machine) ExitEvent() *MachineExitEvent {
+	return m.ExitEventAfter(time.Time{})
+}
+
+// ExitEventAfter returns the most recent exit event of the machine
+// that happened after the given time, or nil if there is none
+func (m *Machine) ExitEventAfter(t time.Time) *MachineExitEvent {
+	var latest *MachineEvent
+	for k, e := range m.Events {
+		if e.Type != "exit" || e.Request == nil || e.Request.ExitEvent == nil {
+			continue
+		}
+
+		// Event timestamps are in milliseconds
+		if e.Timestamp < t.UnixMilli() {
+			continue
+		}
+
+		if latest == nil || e.Timestamp > latest.Timestamp {
+			latest = &m.Events[k]
+		}
+	}
+
+	if latest == nil {
+		return nil
+	}
+
+	return latest.Request.ExitEvent
+}
+
 type MachineConfig struct {
 	Image       string            `json:"image"`
-	Guest       MachineSize       `json:"guest,omitempty"`
+	Guest       *MachineSize      `json:"guest,omitempty"`
 	Size        string            `json:"size,omitempty"`
 	Env         map[string]string `json:"env,omitempty"`
 	Services    []MachineService  `json:"services,omitempty"`
@@ -47,12 +91,67 @@ type MachineConfig struct {
 	AutoDestroy bool              `json:"auto_destroy,omitempty"`
 }
 
+type MachineEvent struct {
+	Type      string               `json:"type"`
+	Status    string               `json:"status"`
+	Source    string               `json:"source"`
+	Timestamp int64                `json:"timestamp"`
+	Request   *MachineEventRequest `json:"request,omitempty"`
+}
+
+type MachineEventRequest struct {
+	ExitEvent *MachineExitEvent `json:"exit_event,omitempty"`
+}
+
+type MachineExitEvent struct {
+	ExitCode      int    `json:"exit_code"`
+	OOMKilled     bool   `json:"oom_killed"`
+	RequestedStop bool   `json:"requested_stop"`
+	ExitedAt      string `json:"exited_at"`
+}
+
+// Succeeded is true if the process exited cleanly
+func (e *MachineExitEvent) Succeeded() bool {
+	return e.ExitCode == 0 && !e.OOMKilled
+}
+
 type MachineSize struct {
 	CpuCount int    `json:"cpus"`
 	RAM      int    `json:"memory_mb"`
 	Type     string `json:"cpu_kind"`
 }
 
+// Validate checks the size against the limits of Fly Machines
+// (without GPUs). See https://fly.io/docs/machines/guides-examples/machine-sizing/
+func (s *MachineSize) Validate() error {
+	var minPerCpu, maxPerCpu int
+	var cpus []int
+	switch s.Type {
+	case TypeShared:
+		minPerCpu, maxPerCpu = 256, 2048
+		cpus = []int{1, 2, 4, 8}
+	case TypePerf:
+		minPerCpu, maxPerCpu = 2048, 8192
+		cpus = []int{1, 2, 4, 8, 16}
+	default:
+		return fmt.Errorf("cpu_kind must be '%s' or '%s', got '%s'", TypeShared, TypePerf, s.Type)
+	}
+
+	if !slices.Contains(cpus, s.CpuCount) {
+		return fmt.Errorf("cpus for %s cpu_kind must be one of %v, got %d", s.Type, cpus, s.CpuCount)
+	}
+
+	if s.RAM%256 != 0 {
+		return fmt.Errorf("memory_mb must be a multiple of 256, got %d", s.RAM)
+	}
+
+	if s.RAM < minPerCpu*s.CpuCount || s.RAM > maxPerCpu*s.CpuCount {
+		return fmt.Errorf("memory_mb for %d %s cpus must be between %d and %d, got %d", s.CpuCount, s.Type, minPerCpu*s.CpuCount, maxPerCpu*s.CpuCount, s.RAM)
+	}
+
+	return nil
+}
+
 type MachineService struct {
 	InternalPort int    `json:"internal_port"` // 8000
 	Protocol     string `json:"protocol"`      // "tcp"
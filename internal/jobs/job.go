@@ -0,0 +1,80 @@
+package jobs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"golang.org/x/exp/slices"
+	"strings"
+	"time"
+)
+
+// Status is where a job is in its lifecycle
+type Status string
+
+const (
+	// StatusPending jobs are waiting on a Machine to be created
+	StatusPending Status = "pending"
+
+	// StatusStarted jobs have a Machine. Unless lambdo waits for
+	// Machines to exit, this is the last status a job gets.
+	StatusStarted Status = "started"
+
+	// StatusSucceeded jobs' Machines exited successfully
+	StatusSucceeded Status = "succeeded"
+
+	// StatusFailed jobs got no Machine, or their Machine
+	// exited unsuccessfully
+	StatusFailed Status = "failed"
+
+	// StatusUnknown jobs' outcome is unknown, e.g. we
+	// stopped waiting for their Machine
+	StatusUnknown Status = "unknown"
+
+	// StatusDuplicate jobs were not run, because their (named)
+	// Machine was already created, e.g. by another lambdo instance
+	StatusDuplicate Status = "duplicate"
+)
+
+// AssignedIdAttribute is the event attribute holding a job ID handed
+// out when the event was accepted (e.g. by the webhook). The job the
+// event ends up in can be found by it, but unlike the job_id attribute,
+// it doesn't keep events from sharing a Machine.
+const AssignedIdAttribute = "assigned_job_id"
+
+// Job is a group of events sent to a Machine, and
+// what happened to them
+type Job struct {
+	Id         string   `json:"id"`
+	Source     string   `json:"source"`
+	MessageIds []string `json:"message_ids"`
+	// Aliases are other IDs the job can be found by, e.g. the
+	// job IDs the webhook handed out for its events
+	Aliases    []string   `json:"aliases,omitempty"`
+	Image      string     `json:"image"`
+	Region     string     `json:"region,omitempty"`
+	MachineId  string     `json:"machine_id,omitempty"`
+	Attempts   int        `json:"attempts"`
+	Status     Status     `json:"status"`
+	Reason     string     `json:"reason,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Finished is true if the job will not change anymore
+// (unless its events are delivered again)
+func (j *Job) Finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed || j.Status == StatusUnknown || j.Status == StatusDuplicate
+}
+
+// IdFor returns a job ID for a group of messages. Redelivered messages
+// get the same ID (if grouped the same way), so their attempts add up.
+func IdFor(messageIds []string) string {
+	sorted := slices.Clone(messageIds)
+	slices.Sort(sorted)
+
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+
+	return "job_" + hex.EncodeToString(sum[:10])
+}
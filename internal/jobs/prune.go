@@ -0,0 +1,43 @@
+package jobs
+
+import (
+	"context"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/logging"
+	"go.uber.org/zap"
+	"time"
+)
+
+// How often to look for jobs older than the retention period
+const pruneInterval = time.Hour
+
+// StartPruning deletes jobs older than the configured retention
+// period from the job store, now and then every pruneInterval,
+// until the context is cancelled
+func StartPruning(ctx context.Context) {
+	retention := time.Duration(config.GetConfig().JobsRetentionHours) * time.Hour
+	if store == nil || retention == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+
+		for {
+			pruned, err := store.Prune(time.Now().Add(-retention))
+			if err != nil {
+				logging.GetLogger().Error("could not prune old jobs", zap.Error(err))
+			} else if pruned > 0 {
+				logging.GetLogger().Debug("pruned old jobs", zap.Int("jobs", pruned))
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				logging.GetLogger().Debug("Shutdown: no longer pruning old jobs")
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,372 @@
+package jobs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/superfly/lambdo/internal/config"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	jobsBucket      = []byte("jobs")
+	createdBucket   = []byte("jobs_by_created")
+	schedulesBucket = []byte("schedules")
+	aliasesBucket   = []byte("job_aliases")
+)
+
+// ErrNotFound is returned when there is no job with a given ID
+var ErrNotFound = errors.New("job not found")
+
+// ErrDisabled is returned when reading jobs while there is no job store
+var ErrDisabled = errors.New("job store is disabled")
+
+// Store keeps track of jobs in a local bbolt database. A nil
+// Store is a disabled one: writes do nothing and reads
+// return ErrDisabled.
+type Store struct {
+	db *bolt.DB
+}
+
+var store *Store
+
+// Configure opens the job store based on the lambdo
+// config. If no database path is set, jobs aren't stored.
+func Configure() error {
+	path := config.GetConfig().JobsDBPath
+	if len(path) == 0 {
+		return nil
+	}
+
+	s, err := Open(path)
+	if err != nil {
+		return err
+	}
+
+	store = s
+
+	return nil
+}
+
+// GetStore returns the configured job store,
+// or nil if jobs aren't stored
+func GetStore() *Store {
+	return store
+}
+
+// Open opens (or creates) a job store at the given path
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("could not create job store directory: %w", err)
+	}
+
+	// Only one process can have the database open, so
+	// don't wait on another one forever
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open job store: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{jobsBucket, createdBucket, schedulesBucket, aliasesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not set up job store: %w", err)
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close closes the job store's database
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Close()
+}
+
+// Begin records a new attempt at a job, which is pending until
+// a Machine is created for it. A job seen before keeps its
+// creation time, and its attempts are counted up.
+func (s *Store) Begin(job *Job) error {
+	now := time.Now().UTC()
+	job.Status = StatusPending
+	job.Attempts = 1
+	job.CreatedAt = now
+	job.UpdatedAt = now
+
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		existing, err := get(tx, job.Id)
+
+		if errors.Is(err, ErrNotFound) {
+			if err := tx.Bucket(createdBucket).Put(createdKey(job), []byte(job.Id)); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else {
+			job.Attempts = existing.Attempts + 1
+			job.CreatedAt = existing.CreatedAt
+		}
+
+		// An alias finds the last job its event was part of
+		for _, alias := range job.Aliases {
+			if err := tx.Bucket(aliasesBucket).Put([]byte(alias), []byte(job.Id)); err != nil {
+				return err
+			}
+		}
+
+		return put(tx, job)
+	})
+}
+
+// Claim records a job as pending before any attempt at it, unless a
+// job with its ID exists already, in which case it returns false.
+// Without a job store, every job can be claimed.
+func (s *Store) Claim(job *Job) (bool, error) {
+	now := time.Now().UTC()
+	job.Status = StatusPending
+	job.CreatedAt = now
+	job.UpdatedAt = now
+
+	if s == nil {
+		return true, nil
+	}
+
+	claimed := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := get(tx, job.Id)
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		if err := tx.Bucket(createdBucket).Put(createdKey(job), []byte(job.Id)); err != nil {
+			return err
+		}
+
+		claimed = true
+		return put(tx, job)
+	})
+
+	return claimed, err
+}
+
+// Update changes a stored job
+func (s *Store) Update(id string, update func(job *Job)) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		job, err := get(tx, id)
+		if err != nil {
+			return err
+		}
+
+		update(job)
+		job.UpdatedAt = time.Now().UTC()
+
+		return put(tx, job)
+	})
+}
+
+// Get returns the job with the given ID (or alias)
+func (s *Store) Get(id string) (*Job, error) {
+	if s == nil {
+		return nil, ErrDisabled
+	}
+
+	var job *Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		job, err = get(tx, id)
+
+		if errors.Is(err, ErrNotFound) {
+			if target := tx.Bucket(aliasesBucket).Get([]byte(id)); target != nil {
+				job, err = get(tx, string(target))
+			}
+		}
+
+		return err
+	})
+
+	return job, err
+}
+
+// List returns up to limit jobs, most recently created first
+func (s *Store) List(limit int) ([]*Job, error) {
+	if s == nil {
+		return nil, ErrDisabled
+	}
+
+	jobs := []*Job{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(createdBucket).Cursor()
+		for k, id := c.Last(); k != nil && len(jobs) < limit; k, id = c.Prev() {
+			job, err := get(tx, string(id))
+			if err != nil {
+				return err
+			}
+
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+
+	return jobs, err
+}
+
+// LastRun returns when the named schedule last ran,
+// or the zero time if it never did (that we know of)
+func (s *Store) LastRun(schedule string) (time.Time, error) {
+	if s == nil {
+		return time.Time{}, nil
+	}
+
+	var last time.Time
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(schedulesBucket).Get([]byte(schedule))
+		if raw == nil {
+			return nil
+		}
+
+		return last.UnmarshalBinary(raw)
+	})
+
+	return last, err
+}
+
+// SetLastRun records when the named schedule last ran,
+// unless a later run was recorded already
+func (s *Store) SetLastRun(schedule string, run time.Time) error {
+	if s == nil {
+		return nil
+	}
+
+	raw, err := run.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(schedulesBucket)
+		if prev := bucket.Get([]byte(schedule)); prev != nil {
+			var last time.Time
+			if err := last.UnmarshalBinary(prev); err == nil && !last.Before(run) {
+				return nil
+			}
+		}
+
+		return bucket.Put([]byte(schedule), raw)
+	})
+}
+
+// Prune deletes jobs that were created and last updated before
+// the given time, and returns how many of them it deleted
+func (s *Store) Prune(before time.Time) (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+
+	pruned := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// Deleting while iterating with a cursor skips keys
+		keys := [][]byte{}
+		ids := map[string]bool{}
+		aliases := []string{}
+		c := tx.Bucket(createdBucket).Cursor()
+		for k, id := c.First(); k != nil && createdAt(k).Before(before); k, id = c.Next() {
+			job, err := get(tx, string(id))
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+
+			// Still being worked on
+			if job != nil && !job.UpdatedAt.Before(before) {
+				continue
+			}
+
+			keys = append(keys, k)
+			ids[string(id)] = true
+			if job != nil {
+				aliases = append(aliases, job.Aliases...)
+			}
+		}
+
+		for _, k := range keys {
+			if err := tx.Bucket(jobsBucket).Delete(tx.Bucket(createdBucket).Get(k)); err != nil {
+				return err
+			}
+
+			if err := tx.Bucket(createdBucket).Delete(k); err != nil {
+				return err
+			}
+		}
+
+		// Their aliases go too, unless they point to a later job by now
+		for _, alias := range aliases {
+			if target := tx.Bucket(aliasesBucket).Get([]byte(alias)); target != nil && ids[string(target)] {
+				if err := tx.Bucket(aliasesBucket).Delete([]byte(alias)); err != nil {
+					return err
+				}
+			}
+		}
+
+		pruned = len(keys)
+		return nil
+	})
+
+	return pruned, err
+}
+
+func get(tx *bolt.Tx, id string) (*Job, error) {
+	raw := tx.Bucket(jobsBucket).Get([]byte(id))
+	if raw == nil {
+		return nil, ErrNotFound
+	}
+
+	job := &Job{}
+	if err := json.Unmarshal(raw, job); err != nil {
+		return nil, fmt.Errorf("could not decode job %s: %w", id, err)
+	}
+
+	return job, nil
+}
+
+func put(tx *bolt.Tx, job *Job) error {
+	raw, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("could not encode job %s: %w", job.Id, err)
+	}
+
+	return tx.Bucket(jobsBucket).Put([]byte(job.Id), raw)
+}
+
+// createdKey sorts jobs by creation time (and then ID)
+func createdKey(job *Job) []byte {
+	key := make([]byte, 8, 8+len(job.Id))
+	binary.BigEndian.PutUint64(key, uint64(job.CreatedAt.UnixNano()))
+
+	return append(key, job.Id...)
+}
+
+// createdAt returns the creation time a createdKey sorts by
+func createdAt(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key[:8])))
+}
@@ -0,0 +1,120 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/superfly/lambdo/internal/source"
+	"time"
+)
+
+// Ack marks the given records as handled, and commits the offset of
+// each of their partitions up to the records that were all acked.
+// Offsets are committed in the generation of the consumer group that
+// assigned us the partitions, which fails once it ended.
+func (s *Source) Ack(ctx context.Context, events []*source.Event) error {
+	var generation *kafka.Generation
+	offsets := map[string]map[int]int64{}
+
+	err := s.each(events, func(p *partition, h handle) {
+		switch {
+		case h.record.state == stateInFlight && h.record.deliveries == h.delivery:
+			p.inFlight--
+		case h.record.state == stateWaiting:
+			// Its lease ran out, but we don't need to hand it out again
+		default:
+			return
+		}
+
+		h.record.state = stateAcked
+	}, func(p *partition) {
+		msg, ok := p.committable()
+		if !ok {
+			return
+		}
+
+		// The committed offset is the next record to consume
+		if offsets[msg.Topic] == nil {
+			offsets[msg.Topic] = map[int]int64{}
+		}
+		offsets[msg.Topic][msg.Partition] = msg.Offset + 1
+		generation = s.generation
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	// Committed offsets include every record before them,
+	// so a failed commit is made up for by the next one
+	if err := generation.CommitOffsets(offsets); err != nil {
+		return fmt.Errorf("could not commit offsets: %w", err)
+	}
+
+	return nil
+}
+
+// Nack puts the given records back, to be handed
+// out again once RetryDelay has passed
+func (s *Source) Nack(ctx context.Context, events []*source.Event) error {
+	retryAt := time.Now().Add(s.RetryDelay)
+
+	return s.each(events, func(p *partition, h handle) {
+		if h.record.state != stateInFlight || h.record.deliveries != h.delivery {
+			return
+		}
+
+		h.record.state = stateWaiting
+		h.record.retryAt = retryAt
+		p.inFlight--
+	}, nil)
+}
+
+// Extend keeps the given records in flight for another d from now
+func (s *Source) Extend(ctx context.Context, events []*source.Event, d time.Duration) error {
+	deadline := time.Now().Add(d)
+
+	return s.each(events, func(p *partition, h handle) {
+		if h.record.state == stateInFlight && h.record.deliveries == h.delivery {
+			h.record.deadline = deadline
+		}
+	}, nil)
+}
+
+// each calls fn for the record of every event, and then done
+// (if set) once for every partition the records are in
+func (s *Source) each(events []*source.Event, fn func(p *partition, h handle), done func(p *partition)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	touched := map[partitionKey]*partition{}
+	for _, e := range events {
+		h, ok := e.Handle.(handle)
+		if !ok {
+			return fmt.Errorf("event %s is not a kafka record", e.Id)
+		}
+
+		// The partition was revoked
+		p, ok := s.partitions[h.key]
+		if !ok || p != h.partition {
+			continue
+		}
+
+		fn(p, h)
+		touched[h.key] = p
+	}
+
+	if done != nil {
+		for _, p := range touched {
+			before := len(p.records)
+			done(p)
+			s.held -= before - len(p.records)
+		}
+	}
+
+	return nil
+}
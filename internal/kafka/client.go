@@ -0,0 +1,249 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/logging"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// At most this many records are held (fetched, but not yet
+// committed) at once, after which we stop fetching more
+const maxHeld = 1000
+
+// How many fetched records may wait to be held
+const fetchBuffer = 100
+
+// Source is an EventSource that consumes Kafka topics with a
+// consumer group. Each record is an event: its value is the event
+// body, and its headers are the event attributes.
+//
+// Kafka only keeps track of a committed offset per partition, so
+// records are held here until they're handled. A partition's offset
+// is only committed up to the records that were all acked, and
+// nacked records are retried from here. Once a rebalance takes a
+// partition away, its records are let go of, and its offset is
+// left to the partition's new owner.
+type Source struct {
+	Topics []string
+	Group  string
+
+	// Ordered keeps records of a partition in order, by never
+	// handing out a partition's records while others are in flight
+	Ordered bool
+
+	// Lease is how long a record may be in flight without being
+	// extended, before it's handed out again (like a visibility timeout)
+	Lease time.Duration
+
+	// RetryDelay is how long nacked records wait before they're retried
+	RetryDelay time.Duration
+
+	brokers []string
+	group   kafka.ConsumerGroupConfig
+
+	fetchOnce sync.Once
+	fetched   chan fetchedRecord
+	fetchErr  chan error
+
+	// Guards the generation, and the partitions it assigned us
+	// along with their records
+	mu         sync.Mutex
+	generation *kafka.Generation
+	partitions map[partitionKey]*partition
+	held       int
+}
+
+// fetchedRecord is a record along with the generation
+// of the consumer group it was fetched in
+type fetchedRecord struct {
+	msg        kafka.Message
+	generation int32
+}
+
+// NewSource returns a Kafka EventSource for the configured
+// brokers, topics and consumer group. It joins the group
+// once events are first received.
+func NewSource() (*Source, error) {
+	brokers := config.GetConfig().KafkaBrokers
+	topics := config.GetConfig().KafkaTopics
+
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("config kafka_topics must be set to consume kafka")
+	}
+
+	group := kafka.ConsumerGroupConfig{
+		ID:          config.GetConfig().KafkaGroup,
+		Brokers:     brokers,
+		Topics:      topics,
+		StartOffset: kafka.FirstOffset,
+		ErrorLogger: errorLogger,
+	}
+
+	if err := group.Validate(); err != nil {
+		return nil, fmt.Errorf("kafka config is invalid: %w", err)
+	}
+
+	return &Source{
+		Topics:     topics,
+		Group:      config.GetConfig().KafkaGroup,
+		Ordered:    config.GetConfig().KafkaOrdered,
+		Lease:      time.Duration(config.GetConfig().LeaseSeconds) * time.Second,
+		RetryDelay: time.Duration(config.GetConfig().KafkaRetryDelaySeconds) * time.Second,
+		brokers:    brokers,
+		group:      group,
+		fetched:    make(chan fetchedRecord, fetchBuffer),
+		fetchErr:   make(chan error, 1),
+		partitions: map[partitionKey]*partition{},
+	}, nil
+}
+
+func (s *Source) Name() string {
+	return "kafka"
+}
+
+// Health checks a broker can be reached, and returns how
+// many records are held and in flight
+func (s *Source) Health(ctx context.Context) (map[string]string, error) {
+	var conn *kafka.Conn
+	var err error
+	for _, broker := range s.brokers {
+		if conn, err = kafka.DialContext(ctx, "tcp", broker); err == nil {
+			conn.Close()
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not reach a kafka broker: %w", err)
+	}
+
+	s.mu.Lock()
+	held, inFlight := s.held, 0
+	for _, p := range s.partitions {
+		inFlight += p.inFlight
+	}
+	s.mu.Unlock()
+
+	return map[string]string{
+		"topics":    strings.Join(s.Topics, ","),
+		"group":     s.Group,
+		"held":      strconv.Itoa(held),
+		"in_flight": strconv.Itoa(inFlight),
+	}, nil
+}
+
+// consume joins the consumer group, and fetches the partitions each
+// generation of the group assigns us, until the context is cancelled.
+// Offsets are only committed once records are acked.
+func (s *Source) consume(ctx context.Context) {
+	logging.GetLogger().Info("joining kafka consumer group", zap.String("group", s.Group), zap.Strings("topics", s.Topics))
+
+	group, err := kafka.NewConsumerGroup(s.group)
+	if err != nil {
+		s.fetchErr <- err
+		return
+	}
+	defer group.Close()
+
+	for {
+		gen, err := group.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			// The group keeps trying to join again
+			select {
+			case s.fetchErr <- err:
+			default:
+			}
+			continue
+		}
+
+		s.assign(gen)
+
+		for topic, assignments := range gen.Assignments {
+			for _, a := range assignments {
+				topic, a := topic, a
+				gen.Start(func(ctx context.Context) {
+					s.fetch(ctx, gen.ID, topic, a)
+				})
+			}
+		}
+	}
+}
+
+// assign starts a new generation of the consumer group, and lets go of
+// the records of partitions it didn't assign us. Acks of records handed
+// out before then no longer find their partition, so its offset is not
+// committed by us anymore.
+func (s *Source) assign(gen *kafka.Generation) {
+	assigned := map[partitionKey]bool{}
+	for topic, assignments := range gen.Assignments {
+		for _, a := range assignments {
+			assigned[partitionKey{topic, a.ID}] = true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation = gen
+
+	revoked := 0
+	for key, p := range s.partitions {
+		if !assigned[key] {
+			s.held -= len(p.records)
+			delete(s.partitions, key)
+			revoked++
+		}
+	}
+
+	logging.GetLogger().Info("kafka partitions assigned", zap.String("group", s.Group), zap.Int32("generation", gen.ID), zap.Int("partitions", len(assigned)), zap.Int("revoked", revoked))
+}
+
+// fetch reads the records of an assigned partition, from its committed
+// offset, and hands them to Receive until the generation ends. Records
+// we already hold are fetched again, and skipped.
+func (s *Source) fetch(ctx context.Context, generation int32, topic string, a kafka.PartitionAssignment) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     s.brokers,
+		Topic:       topic,
+		Partition:   a.ID,
+		ErrorLogger: errorLogger,
+	})
+	defer reader.Close()
+
+	if err := reader.SetOffset(a.Offset); err != nil {
+		logging.GetLogger().Error("could not set kafka offset", zap.String("topic", topic), zap.Int("partition", a.ID), zap.Error(err))
+		return
+	}
+
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			// Returning ends the generation, and the group rebalances
+			if ctx.Err() == nil {
+				logging.GetLogger().Error("could not fetch kafka records", zap.String("topic", topic), zap.Int("partition", a.ID), zap.Error(err))
+			}
+			return
+		}
+
+		select {
+		case s.fetched <- fetchedRecord{msg: msg, generation: generation}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+var errorLogger = kafka.LoggerFunc(func(msg string, args ...interface{}) {
+	logging.GetLogger().Warn("kafka error", zap.String("error", fmt.Sprintf(msg, args...)))
+})
@@ -0,0 +1,187 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/source"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"strings"
+	"time"
+)
+
+// headerPrefix is optional on headers, e.g. "Lambdo-Image"
+// and "image" are both the "image" attribute
+const headerPrefix = "lambdo-"
+
+// How often to look for records that are due again (retried,
+// or freed up by acks) while waiting for new ones
+const recheckInterval = 250 * time.Millisecond
+
+// Receive returns the next records that can be handed out, waiting
+// up to the long poll time for some. The consumer group is joined
+// the first time this is called.
+func (s *Source) Receive(ctx context.Context) ([]*source.Event, error) {
+	s.fetchOnce.Do(func() {
+		go s.consume(ctx)
+	})
+
+	wait := time.Duration(config.GetConfig().PollSeconds) * time.Second
+	if wait < recheckInterval {
+		wait = recheckInterval
+	}
+
+	deadline := time.Now().Add(wait)
+
+	ticker := time.NewTicker(recheckInterval)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		s.hold()
+		events := s.take(time.Now(), config.GetConfig().EventsPerMachine)
+
+		// Stop fetching while we hold too many records, so
+		// the ones in flight (or waiting) are handled first
+		fetched := s.fetched
+		if s.held >= maxHeld {
+			fetched = nil
+		}
+		s.mu.Unlock()
+
+		if len(events) > 0 || !time.Now().Before(deadline) {
+			return events, nil
+		}
+
+		select {
+		case f := <-fetched:
+			s.mu.Lock()
+			s.add(f)
+			s.mu.Unlock()
+		case <-ticker.C:
+		case err := <-s.fetchErr:
+			return nil, fmt.Errorf("could not fetch records: %w", err)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// hold takes the records that were already fetched, so they
+// can be batched together, as long as there's room for them
+func (s *Source) hold() {
+	for s.held < maxHeld {
+		select {
+		case f := <-s.fetched:
+			s.add(f)
+		default:
+			return
+		}
+	}
+}
+
+// add holds a fetched record, unless it was fetched in an earlier
+// generation, whose partitions may have been assigned elsewhere since
+func (s *Source) add(f fetchedRecord) {
+	if s.generation == nil || f.generation != s.generation.ID {
+		return
+	}
+
+	msg := f.msg
+	key := partitionKey{msg.Topic, msg.Partition}
+	p, ok := s.partitions[key]
+	if !ok {
+		p = &partition{next: msg.Offset}
+		s.partitions[key] = p
+	}
+
+	if p.add(msg) {
+		s.held++
+	}
+}
+
+// take hands out up to limit waiting records that are due. In ordered
+// mode, they all come from one partition that has nothing in flight,
+// and they're only batched together while their headers match, since
+// each batch may become a Machine of its own.
+func (s *Source) take(now time.Time, limit int) []*source.Event {
+	events := []*source.Event{}
+
+	for key, p := range s.partitions {
+		p.expire(now)
+
+		if s.Ordered && p.inFlight > 0 {
+			continue
+		}
+
+		var first *record
+		for _, r := range p.records {
+			if len(events) >= limit {
+				break
+			}
+
+			if r.state != stateWaiting {
+				continue
+			}
+
+			if r.retryAt.After(now) {
+				// Nothing may overtake it
+				if s.Ordered {
+					break
+				}
+				continue
+			}
+
+			if s.Ordered && first != nil && !sameHeaders(first, r) {
+				break
+			}
+
+			if first == nil {
+				first = r
+			}
+
+			r.state = stateInFlight
+			r.deadline = now.Add(s.Lease)
+			r.deliveries++
+			p.inFlight++
+
+			events = append(events, toEvent(key, p, r))
+		}
+
+		if (s.Ordered && len(events) > 0) || len(events) >= limit {
+			break
+		}
+	}
+
+	if len(events) > 0 {
+		logging.GetLogger().Debug("handing out kafka records", zap.Int("records", len(events)))
+	}
+
+	return events
+}
+
+func sameHeaders(a, b *record) bool {
+	return maps.Equal(attributes(a), attributes(b))
+}
+
+func attributes(r *record) map[string]string {
+	attributes := map[string]string{}
+	for _, h := range r.msg.Headers {
+		attr := strings.TrimPrefix(strings.ToLower(h.Key), headerPrefix)
+		attributes[strings.ReplaceAll(attr, "-", "_")] = string(h.Value)
+	}
+
+	return attributes
+}
+
+func toEvent(key partitionKey, p *partition, r *record) *source.Event {
+	return &source.Event{
+		Id:           fmt.Sprintf("%s/%d/%d", r.msg.Topic, r.msg.Partition, r.msg.Offset),
+		Body:         string(r.msg.Value),
+		Attributes:   attributes(r),
+		ReceiveCount: r.deliveries,
+		Handle:       handle{key: key, partition: p, record: r, delivery: r.deliveries},
+	}
+}
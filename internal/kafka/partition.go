@@ -0,0 +1,97 @@
+package kafka
+
+import (
+	"github.com/segmentio/kafka-go"
+	"time"
+)
+
+// States of a held record
+const (
+	stateWaiting = iota
+	stateInFlight
+	stateAcked
+)
+
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+// partition holds the records of a partition that were fetched
+// but not committed yet, in offset order
+type partition struct {
+	records []*record
+
+	// inFlight is how many of the records were handed out
+	inFlight int
+
+	// next is the offset we expect to fetch next, records
+	// before it are fetched again after a rebalance
+	next int64
+}
+
+type record struct {
+	msg   kafka.Message
+	state int
+
+	// deliveries is how many times the record was
+	// handed out, which also identifies the delivery
+	deliveries int
+
+	// retryAt is when a waiting record may be handed out
+	retryAt time.Time
+
+	// deadline is when an in-flight record's lease runs out
+	deadline time.Time
+}
+
+// handle is the event handle, so late replies to a record that
+// was handed out again (or whose partition was revoked, and maybe
+// assigned to us again since) can be told apart
+type handle struct {
+	key       partitionKey
+	partition *partition
+	record    *record
+	delivery  int
+}
+
+// add holds a fetched record, unless it was already fetched
+func (p *partition) add(msg kafka.Message) bool {
+	if msg.Offset < p.next {
+		return false
+	}
+
+	p.next = msg.Offset + 1
+	p.records = append(p.records, &record{msg: msg})
+
+	return true
+}
+
+// committable removes the records at the start of the partition that
+// were all acked, and returns the last of them (the offset to commit)
+func (p *partition) committable() (kafka.Message, bool) {
+	var last *record
+	for len(p.records) > 0 && p.records[0].state == stateAcked {
+		last = p.records[0]
+		p.records = p.records[1:]
+	}
+
+	if last == nil {
+		return kafka.Message{}, false
+	}
+
+	return last.msg, true
+}
+
+// expire puts back in-flight records whose lease ran out, so they
+// can be handed out again (e.g. the broker couldn't tell whether
+// their Machine succeeded, and left them alone)
+func (p *partition) expire(now time.Time) {
+	for _, r := range p.records {
+		if r.state == stateInFlight && now.After(r.deadline) {
+			r.state = stateWaiting
+			r.retryAt = now
+			p.inFlight--
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const namespace = "lambdo"
+
+var registry = prometheus.NewRegistry()
+
+var (
+	// MessagesReceived counts events received, per source
+	MessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Events received from a source.",
+	}, []string{"source"})
+
+	// ReceiveErrors counts failed attempts to receive events, per source
+	ReceiveErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "receive_errors_total",
+		Help:      "Failed attempts to receive events from a source.",
+	}, []string{"source"})
+
+	// MessagesAcked counts events deleted from their source once handled
+	MessagesAcked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_acked_total",
+		Help:      "Events acked (deleted) from their source.",
+	}, []string{"source"})
+
+	// MessagesNacked counts events handed back to their source to be retried
+	MessagesNacked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_nacked_total",
+		Help:      "Events handed back to their source to be retried.",
+	}, []string{"source"})
+
+	// MessagesDeadLettered counts events moved to the dead-letter queue
+	MessagesDeadLettered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_dead_lettered_total",
+		Help:      "Events moved to the dead-letter queue.",
+	}, []string{"source"})
+
+	// BatchesDispatched counts groups of events sent to a Machine
+	BatchesDispatched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "batches_dispatched_total",
+		Help:      "Groups of events sent to a Machine.",
+	}, []string{"source"})
+
+	// MachineCreateDuration times Machine creation, per region
+	MachineCreateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "machine_create_duration_seconds",
+		Help:      "How long creating a Machine took, including retries.",
+		Buckets:   []float64{0.25, 0.5, 1, 2, 5, 10, 30, 60},
+	}, []string{"region"})
+
+	// MachineCreateFailures counts Machines that could not be
+	// created, per region and Fly API status code
+	MachineCreateFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "machine_create_failures_total",
+		Help:      "Machines that could not be created.",
+	}, []string{"region", "status"})
+
+	// FlyRequests counts requests (including retries)
+	// made to the Fly Machines API
+	FlyRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fly_requests_total",
+		Help:      "Requests made to the Fly Machines API, including retries.",
+	}, []string{"method", "status"})
+
+	// FlyRetries counts retried requests to the Fly Machines API
+	FlyRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fly_request_retries_total",
+		Help:      "Requests to the Fly Machines API that were retried.",
+	}, []string{"method"})
+
+	// JobsInFlight is how many jobs are being handled right now, per image
+	JobsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "jobs_in_flight",
+		Help:      "Jobs waiting on or running in a Machine.",
+	}, []string{"image"})
+
+	// JobDuration times jobs from dispatch until lambdo is done with them
+	JobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_duration_seconds",
+		Help:      "How long jobs took, from being dispatched until lambdo was done with them.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 3600},
+	}, []string{"status"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		MessagesReceived,
+		ReceiveErrors,
+		MessagesAcked,
+		MessagesNacked,
+		MessagesDeadLettered,
+		BatchesDispatched,
+		MachineCreateDuration,
+		MachineCreateFailures,
+		FlyRequests,
+		FlyRetries,
+		JobsInFlight,
+		JobDuration,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,50 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/superfly/lambdo/internal/source"
+	"time"
+)
+
+// Ack acknowledges the given messages, waiting for
+// JetStream to confirm it got each ack
+func (s *Source) Ack(ctx context.Context, events []*source.Event) error {
+	return each(events, func(msg jetstream.Msg) error {
+		return msg.DoubleAck(ctx)
+	})
+}
+
+// Nack has JetStream redeliver the given
+// messages, once NakDelay has passed
+func (s *Source) Nack(ctx context.Context, events []*source.Event) error {
+	return each(events, func(msg jetstream.Msg) error {
+		return msg.NakWithDelay(s.NakDelay)
+	})
+}
+
+// Extend tells JetStream the given messages are still being
+// worked on, which resets their ack wait. The duration is
+// up to the consumer's ack wait.
+func (s *Source) Extend(ctx context.Context, events []*source.Event, d time.Duration) error {
+	return each(events, func(msg jetstream.Msg) error {
+		return msg.InProgress()
+	})
+}
+
+// each calls fn for the JetStream message of every event
+func each(events []*source.Event, fn func(msg jetstream.Msg) error) error {
+	for _, e := range events {
+		msg, ok := e.Handle.(jetstream.Msg)
+		if !ok {
+			return fmt.Errorf("event %s is not a jetstream message", e.Id)
+		}
+
+		if err := fn(msg); err != nil {
+			return fmt.Errorf("could not reply to message %s: %w", e.Id, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/logging"
+	"go.uber.org/zap"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Source is an EventSource backed by a JetStream pull consumer. Each
+// message is an event: its data is the event body, and its headers
+// are the event attributes.
+type Source struct {
+	Stream   string
+	Consumer string
+
+	// Subject, if set, filters which of the stream's
+	// messages a newly created consumer gets
+	Subject string
+
+	// NakDelay is how long nacked messages wait
+	// before they are redelivered
+	NakDelay time.Duration
+
+	conn *nats.Conn
+	js   jetstream.JetStream
+
+	consumerOnce sync.Once
+	consumer     jetstream.Consumer
+	consumerErr  error
+}
+
+// NewSource connects to NATS, and returns a JetStream
+// EventSource for the configured stream and consumer
+func NewSource() (*Source, error) {
+	opts := []nats.Option{
+		nats.Name("lambdo"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logging.GetLogger().Warn("disconnected from nats", zap.Error(err))
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			logging.GetLogger().Info("reconnected to nats", zap.String("url", c.ConnectedUrlRedacted()))
+		}),
+	}
+
+	if creds := config.GetConfig().NatsCredsFile; len(creds) > 0 {
+		opts = append(opts, nats.UserCredentials(creds))
+	}
+
+	conn, err := nats.Connect(config.GetConfig().NatsUrl, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to nats: %w", err)
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not use jetstream: %w", err)
+	}
+
+	return &Source{
+		Stream:   config.GetConfig().NatsStream,
+		Consumer: config.GetConfig().NatsConsumer,
+		Subject:  config.GetConfig().NatsSubject,
+		NakDelay: time.Duration(config.GetConfig().NatsNakDelaySeconds) * time.Second,
+		conn:     conn,
+		js:       js,
+	}, nil
+}
+
+func (s *Source) Name() string {
+	return "nats"
+}
+
+// Health checks the consumer can be reached, and returns
+// how many messages are waiting for it or being handled
+func (s *Source) Health(ctx context.Context) (map[string]string, error) {
+	consumer, err := s.getConsumer(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := consumer.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get consumer info: %w", err)
+	}
+
+	return map[string]string{
+		"stream":      s.Stream,
+		"consumer":    s.Consumer,
+		"pending":     strconv.FormatUint(info.NumPending, 10),
+		"ack_pending": strconv.Itoa(info.NumAckPending),
+	}, nil
+}
+
+// getConsumer looks up the durable consumer, creating it if it doesn't
+// exist yet. An existing consumer is used as-is, so it can be set up
+// differently (as long as it acks explicitly).
+func (s *Source) getConsumer(ctx context.Context) (jetstream.Consumer, error) {
+	s.consumerOnce.Do(func() {
+		s.consumer, s.consumerErr = s.js.Consumer(ctx, s.Stream, s.Consumer)
+		if !errors.Is(s.consumerErr, jetstream.ErrConsumerNotFound) {
+			return
+		}
+
+		logging.GetLogger().Info("creating jetstream consumer", zap.String("stream", s.Stream), zap.String("consumer", s.Consumer))
+		s.consumer, s.consumerErr = s.js.CreateConsumer(ctx, s.Stream, jetstream.ConsumerConfig{
+			Durable:       s.Consumer,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			AckWait:       time.Duration(config.GetConfig().LeaseSeconds) * time.Second,
+			FilterSubject: s.Subject,
+		})
+	})
+
+	if s.consumerErr != nil {
+		return nil, fmt.Errorf("could not get jetstream consumer: %w", s.consumerErr)
+	}
+
+	return s.consumer, nil
+}
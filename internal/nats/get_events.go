@@ -0,0 +1,84 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/source"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+// headerPrefix is optional on headers, e.g. "Lambdo-Image"
+// and "image" are both the "image" attribute
+const headerPrefix = "lambdo-"
+
+// Receive fetches the next batch of messages from the consumer
+func (s *Source) Receive(ctx context.Context) ([]*source.Event, error) {
+	consumer, err := s.getConsumer(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch isn't cancelled by the context, so this also
+	// bounds how long shutting down can take
+	wait := time.Duration(config.GetConfig().PollSeconds) * time.Second
+	if wait < time.Second {
+		wait = time.Second
+	}
+
+	logging.GetLogger().Debug("about to fetch jetstream messages", zap.String("stream", s.Stream))
+	batch, err := consumer.Fetch(config.GetConfig().EventsPerMachine, jetstream.FetchMaxWait(wait))
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch messages: %w", err)
+	}
+
+	events := []*source.Event{}
+	for msg := range batch.Messages() {
+		e, err := toEvent(msg)
+		if err != nil {
+			logging.GetLogger().Error("could not read jetstream message", zap.Error(err))
+			continue
+		}
+
+		events = append(events, e)
+	}
+
+	if err := batch.Error(); err != nil {
+		// Messages we got are still worth handling
+		logging.GetLogger().Warn("jetstream fetch ended with an error", zap.Error(err), zap.Int("messages", len(events)))
+		if len(events) == 0 {
+			return nil, fmt.Errorf("could not fetch messages: %w", err)
+		}
+	}
+
+	return events, nil
+}
+
+func toEvent(msg jetstream.Msg) (*source.Event, error) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]string{}
+	for name, values := range msg.Headers() {
+		if len(values) == 0 {
+			continue
+		}
+
+		attr := strings.TrimPrefix(strings.ToLower(name), headerPrefix)
+		attributes[strings.ReplaceAll(attr, "-", "_")] = values[0]
+	}
+
+	return &source.Event{
+		Id:           fmt.Sprintf("%s:%d", meta.Stream, meta.Sequence.Stream),
+		Body:         string(msg.Data()),
+		Attributes:   attributes,
+		ReceiveCount: int(meta.NumDelivered),
+		Handle:       msg,
+	}, nil
+}
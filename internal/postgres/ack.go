@@ -0,0 +1,71 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/source"
+	"time"
+)
+
+// Ack marks the given rows as done
+func (s *Source) Ack(ctx context.Context, events []*source.Event) error {
+	return s.update(ctx, events, `
+		status = 'done',
+		locked_until = NULL`,
+	)
+}
+
+// Nack puts the given rows back, to be retried once RetryDelay has
+// passed. Rows that were already tried MaxReceiveCount times (and
+// weren't dead-lettered) are marked as failed instead.
+func (s *Source) Nack(ctx context.Context, events []*source.Event) error {
+	return s.update(ctx, events, `
+		status = CASE WHEN $3 > 0 AND t.attempts >= $3 THEN 'failed' ELSE 'pending' END,
+		run_at = now() + make_interval(secs => $4),
+		locked_until = NULL`,
+		config.GetConfig().MaxReceiveCount, s.RetryDelay.Seconds(),
+	)
+}
+
+// Extend keeps the given rows locked for another d from now
+func (s *Source) Extend(ctx context.Context, events []*source.Event, d time.Duration) error {
+	return s.update(ctx, events, `
+		locked_until = now() + make_interval(secs => $3)`,
+		d.Seconds(),
+	)
+}
+
+// update sets the given columns on the rows of the events, as long
+// as they're still running with the attempt we claimed them with.
+// Extra arguments start at $3.
+func (s *Source) update(ctx context.Context, events []*source.Event, set string, args ...any) error {
+	ids := make([]int64, 0, len(events))
+	attempts := make([]int32, 0, len(events))
+
+	for _, e := range events {
+		c, ok := e.Handle.(claim)
+		if !ok {
+			return fmt.Errorf("event %s is not a postgres row", e.Id)
+		}
+
+		ids = append(ids, c.id)
+		attempts = append(attempts, c.attempts)
+	}
+
+	_, err := s.pool.Exec(ctx, fmt.Sprintf(`
+		UPDATE %s AS t SET %s,
+			updated_at = now()
+		FROM unnest($1::bigint[], $2::integer[]) AS claimed(id, attempts)
+		WHERE t.id = claimed.id
+			AND t.attempts = claimed.attempts
+			AND t.status = 'running'`, s.Table, set),
+		append([]any{ids, attempts}, args...)...,
+	)
+
+	if err != nil {
+		return fmt.Errorf("could not update rows: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/superfly/lambdo/internal/config"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Statuses of a row in the jobs table
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// Table names are used as-is in queries (and as the
+// notification channel), so they're kept simple
+var tablePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,49}$`)
+
+// Source is an EventSource backed by a Postgres table used as a job
+// queue. Rows are claimed with FOR UPDATE SKIP LOCKED, so any number of
+// lambdo instances can share a table, and each row's status is written
+// back to it as it's handled.
+type Source struct {
+	Table string
+
+	// Lease is how long a claimed row is locked for (and extended by)
+	// before another instance may claim it
+	Lease time.Duration
+
+	// RetryDelay is how long nacked rows wait before they are retried
+	RetryDelay time.Duration
+
+	// PollInterval is how long to wait for a notification
+	// before looking for rows again
+	PollInterval time.Duration
+
+	url      string
+	pool     *pgxpool.Pool
+	listener *pgx.Conn
+}
+
+// NewSource returns a Postgres EventSource for the configured table.
+// Connections are made as they're needed.
+func NewSource(ctx context.Context) (*Source, error) {
+	table, err := tableName()
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := pgxpool.New(ctx, config.GetConfig().PostgresUrl)
+	if err != nil {
+		return nil, fmt.Errorf("could not set up postgres connections: %w", err)
+	}
+
+	// Rows whose lease ran out (or are due later) don't notify us, so
+	// this is also how long it can take for them to be picked up
+	pollInterval := time.Duration(config.GetConfig().PollSeconds) * time.Second
+	if pollInterval < time.Second {
+		pollInterval = time.Second
+	}
+
+	return &Source{
+		Table:        table,
+		Lease:        time.Duration(config.GetConfig().LeaseSeconds) * time.Second,
+		RetryDelay:   time.Duration(config.GetConfig().PostgresRetryDelaySeconds) * time.Second,
+		PollInterval: pollInterval,
+		url:          config.GetConfig().PostgresUrl,
+		pool:         pool,
+	}, nil
+}
+
+func (s *Source) Name() string {
+	return "postgres"
+}
+
+// Health checks the table can be queried, and returns
+// how many rows are waiting or being handled
+func (s *Source) Health(ctx context.Context) (map[string]string, error) {
+	var pending, running int64
+	err := s.pool.QueryRow(ctx, fmt.Sprintf(`
+		SELECT
+			count(*) FILTER (WHERE status = 'pending'),
+			count(*) FILTER (WHERE status = 'running')
+		FROM %s
+		WHERE status IN ('pending', 'running')`, s.Table),
+	).Scan(&pending, &running)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not count rows: %w", err)
+	}
+
+	return map[string]string{
+		"table":   s.Table,
+		"pending": strconv.FormatInt(pending, 10),
+		"running": strconv.FormatInt(running, 10),
+	}, nil
+}
+
+func tableName() (string, error) {
+	table := config.GetConfig().PostgresTable
+	if !tablePattern.MatchString(table) {
+		return "", fmt.Errorf("config postgres_table %q must be lowercase letters, numbers and underscores", table)
+	}
+
+	return table, nil
+}
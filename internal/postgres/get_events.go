@@ -0,0 +1,149 @@
+package postgres
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/source"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+// claim is the event handle, used to make sure we only update
+// rows that weren't claimed by someone else in the meantime
+type claim struct {
+	id       int64
+	attempts int32
+}
+
+// Receive claims the next due rows. If there are none, it waits for
+// rows to be added (or the poll interval to pass) and looks again.
+func (s *Source) Receive(ctx context.Context) ([]*source.Event, error) {
+	events, err := s.claim(ctx)
+	if err != nil || len(events) > 0 {
+		return events, err
+	}
+
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return s.claim(ctx)
+}
+
+// claim locks up to EventsPerMachine rows that are due, or whose
+// lease ran out (e.g. because the lambdo instance handling them
+// stopped), and marks them as running
+func (s *Source) claim(ctx context.Context) ([]*source.Event, error) {
+	logging.GetLogger().Debug("about to claim postgres rows", zap.String("table", s.Table))
+
+	rows, err := s.pool.Query(ctx, fmt.Sprintf(`
+		UPDATE %[1]s SET
+			status = 'running',
+			attempts = attempts + 1,
+			locked_until = now() + make_interval(secs => $2),
+			updated_at = now()
+		WHERE id IN (
+			SELECT id FROM %[1]s
+			WHERE (status = 'pending' AND run_at <= now())
+				OR (status = 'running' AND locked_until < now())
+			ORDER BY run_at, id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, body::text, attributes, attempts`, s.Table),
+		config.GetConfig().EventsPerMachine, s.Lease.Seconds(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not claim rows: %w", err)
+	}
+
+	events := []*source.Event{}
+	for rows.Next() {
+		var c claim
+		var body string
+		var attributes map[string]any
+
+		if err := rows.Scan(&c.id, &body, &attributes, &c.attempts); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("could not read claimed row: %w", err)
+		}
+
+		events = append(events, &source.Event{
+			Id:           strconv.FormatInt(c.id, 10),
+			Body:         body,
+			Attributes:   toAttributes(attributes),
+			ReceiveCount: int(c.attempts),
+			Handle:       c,
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not claim rows: %w", err)
+	}
+
+	return events, nil
+}
+
+// wait blocks until a notification arrives on the table's channel, or
+// the poll interval passes. It keeps a connection of its own to LISTEN
+// on, so notifications sent while we're busy claiming aren't missed.
+func (s *Source) wait(ctx context.Context) error {
+	if s.listener == nil {
+		conn, err := pgx.Connect(ctx, s.url)
+		if err != nil {
+			return fmt.Errorf("could not connect to listen for rows: %w", err)
+		}
+
+		if _, err := conn.Exec(ctx, "LISTEN "+s.Table); err != nil {
+			conn.Close(context.Background())
+			return fmt.Errorf("could not listen for rows: %w", err)
+		}
+
+		s.listener = conn
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, s.PollInterval)
+	defer cancel()
+
+	_, err := s.listener.WaitForNotification(waitCtx)
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case errors.Is(err, context.DeadlineExceeded):
+		return nil
+	}
+
+	// The connection is set up again next time
+	s.listener.Close(context.Background())
+	s.listener = nil
+
+	return fmt.Errorf("could not wait for rows: %w", err)
+}
+
+// toAttributes turns the row's attributes into event attributes. Values
+// that aren't strings are kept as JSON, e.g. a command can be an array.
+func toAttributes(values map[string]any) map[string]string {
+	attributes := map[string]string{}
+	for name, value := range values {
+		if str, ok := value.(string); ok {
+			attributes[name] = str
+			continue
+		}
+
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			continue
+		}
+
+		attributes[name] = string(encoded)
+	}
+
+	return attributes
+}
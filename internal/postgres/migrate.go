@@ -0,0 +1,58 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/superfly/lambdo/internal/config"
+)
+
+// schema creates the jobs table, an index to find rows that are due, and
+// a trigger to notify listening lambdo instances when rows are added.
+// Every statement can be run again, e.g. on every deploy.
+const schema = `
+CREATE TABLE IF NOT EXISTS %[1]s (
+	id           bigserial PRIMARY KEY,
+	body         jsonb NOT NULL,
+	attributes   jsonb NOT NULL DEFAULT '{}',
+	status       text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'done', 'failed')),
+	attempts     integer NOT NULL DEFAULT 0,
+	run_at       timestamptz NOT NULL DEFAULT now(),
+	locked_until timestamptz,
+	created_at   timestamptz NOT NULL DEFAULT now(),
+	updated_at   timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS %[1]s_due_idx ON %[1]s (run_at, id) WHERE status IN ('pending', 'running');
+
+CREATE OR REPLACE FUNCTION %[1]s_notify() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('%[1]s', '');
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS %[1]s_notify ON %[1]s;
+CREATE TRIGGER %[1]s_notify AFTER INSERT ON %[1]s FOR EACH STATEMENT EXECUTE FUNCTION %[1]s_notify();
+`
+
+// Migrate creates (or updates) the configured jobs table
+func Migrate(ctx context.Context) error {
+	table, err := tableName()
+	if err != nil {
+		return err
+	}
+
+	conn, err := pgx.Connect(ctx, config.GetConfig().PostgresUrl)
+	if err != nil {
+		return fmt.Errorf("could not connect to postgres: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	// Sent as one simple query, which runs in a single transaction
+	if _, err := conn.Exec(ctx, fmt.Sprintf(schema, table)); err != nil {
+		return fmt.Errorf("could not create the %s table: %w", table, err)
+	}
+
+	return nil
+}
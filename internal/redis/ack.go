@@ -0,0 +1,70 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/superfly/lambdo/internal/source"
+	"time"
+)
+
+// Ack acknowledges the given entries, removing them
+// from the consumer group's pending entries
+func (s *Source) Ack(ctx context.Context, events []*source.Event) error {
+	if err := s.client.XAck(ctx, s.Stream, s.Group, entryIds(events)...).Err(); err != nil {
+		return fmt.Errorf("could not ack entries: %w", err)
+	}
+
+	return nil
+}
+
+// Nack leaves the given entries to be claimed again once RetryDelay
+// has passed, by marking them as idle for the rest of ClaimIdle
+func (s *Source) Nack(ctx context.Context, events []*source.Event) error {
+	idle := s.ClaimIdle - s.RetryDelay
+	if idle < 0 {
+		idle = 0
+	}
+
+	args := []any{"XCLAIM", s.Stream, s.Group, s.Consumer, 0}
+	for _, id := range entryIds(events) {
+		args = append(args, id)
+	}
+	args = append(args, "IDLE", idle.Milliseconds(), "JUSTID")
+
+	if err := s.client.Do(ctx, args...).Err(); err != nil {
+		return fmt.Errorf("could not nack entries: %w", err)
+	}
+
+	return nil
+}
+
+// Extend claims the given entries again (for ourselves), which
+// resets their idle time so no other consumer claims them
+func (s *Source) Extend(ctx context.Context, events []*source.Event, d time.Duration) error {
+	err := s.client.XClaimJustID(ctx, &redis.XClaimArgs{
+		Stream:   s.Stream,
+		Group:    s.Group,
+		Consumer: s.Consumer,
+		Messages: entryIds(events),
+	}).Err()
+
+	if err != nil {
+		return fmt.Errorf("could not extend entries: %w", err)
+	}
+
+	return nil
+}
+
+// entryIds pulls the stream entry IDs out
+// of events created by this source
+func entryIds(events []*source.Event) []string {
+	ids := make([]string, 0, len(events))
+	for _, e := range events {
+		if id, ok := e.Handle.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
@@ -0,0 +1,120 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/superfly/lambdo/internal/config"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source is an EventSource backed by a Redis stream, read by a
+// consumer group. Each stream entry is an event: its "body" field
+// is the event body, and every other field is an attribute.
+type Source struct {
+	Stream   string
+	Group    string
+	Consumer string
+
+	// ClaimIdle is how long an entry can go without being acked
+	// (or extended) before another consumer may claim it
+	ClaimIdle time.Duration
+
+	// RetryDelay is how long nacked entries wait before they
+	// are claimed again, at most ClaimIdle
+	RetryDelay time.Duration
+
+	client *redis.Client
+
+	groupOnce sync.Once
+	groupErr  error
+
+	mu          sync.Mutex
+	lastReclaim time.Time
+}
+
+// NewSource returns a Redis stream EventSource
+// for the configured stream and consumer group
+func NewSource() (*Source, error) {
+	opts, err := redis.ParseURL(config.GetConfig().RedisUrl)
+	if err != nil {
+		return nil, fmt.Errorf("config redis_url is invalid: %w", err)
+	}
+
+	consumer := config.GetConfig().RedisConsumer
+	if len(consumer) == 0 {
+		consumer = defaultConsumer()
+	}
+
+	return &Source{
+		Stream:     config.GetConfig().RedisStream,
+		Group:      config.GetConfig().RedisGroup,
+		Consumer:   consumer,
+		ClaimIdle:  time.Duration(config.GetConfig().LeaseSeconds) * time.Second,
+		RetryDelay: time.Duration(config.GetConfig().RedisRetryDelaySeconds) * time.Second,
+		client:     redis.NewClient(opts),
+	}, nil
+}
+
+func (s *Source) Name() string {
+	return "redis"
+}
+
+// Health checks Redis can be reached, and returns the length
+// of the stream and how many entries are pending
+func (s *Source) Health(ctx context.Context) (map[string]string, error) {
+	length, err := s.client.XLen(ctx, s.Stream).Result()
+	if err != nil {
+		return nil, fmt.Errorf("could not get stream length: %w", err)
+	}
+
+	details := map[string]string{
+		"stream": s.Stream,
+		"group":  s.Group,
+		"length": fmt.Sprint(length),
+	}
+
+	pending, err := s.client.XPending(ctx, s.Stream, s.Group).Result()
+	if err != nil && !isNoGroup(err) {
+		return nil, fmt.Errorf("could not get pending entries: %w", err)
+	}
+
+	if pending != nil {
+		details["pending"] = fmt.Sprint(pending.Count)
+	}
+
+	return details, nil
+}
+
+// ensureGroup creates the consumer group (and stream) if
+// they don't exist yet. New groups only see new entries.
+func (s *Source) ensureGroup(ctx context.Context) error {
+	s.groupOnce.Do(func() {
+		err := s.client.XGroupCreateMkStream(ctx, s.Stream, s.Group, "$").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			s.groupErr = fmt.Errorf("could not create consumer group: %w", err)
+		}
+	})
+
+	return s.groupErr
+}
+
+// defaultConsumer names this lambdo instance within the consumer group
+func defaultConsumer() string {
+	if id := os.Getenv("FLY_MACHINE_ID"); len(id) > 0 {
+		return id
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+
+	return "lambdo"
+}
+
+func isNoGroup(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOGROUP")
+}
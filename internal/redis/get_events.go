@@ -0,0 +1,162 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/source"
+	"go.uber.org/zap"
+	"time"
+)
+
+// bodyField is the stream entry field holding the event body
+const bodyField = "body"
+
+// Receive gets the next batch of entries, first reclaiming any that
+// other (presumably dead) consumers have not acked in time
+func (s *Source) Receive(ctx context.Context) ([]*source.Event, error) {
+	if err := s.ensureGroup(ctx); err != nil {
+		return nil, err
+	}
+
+	count := int64(config.GetConfig().EventsPerMachine)
+
+	events, err := s.reclaim(ctx, count)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(events) > 0 {
+		return events, nil
+	}
+
+	block := time.Duration(config.GetConfig().PollSeconds) * time.Second
+	if block < 1 {
+		// 0 blocks forever, which would ignore shutdown
+		block = 250 * time.Millisecond
+	}
+
+	logging.GetLogger().Debug("about to call XREADGROUP", zap.String("stream", s.Stream))
+	streams, err := s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    s.Group,
+		Consumer: s.Consumer,
+		Streams:  []string{s.Stream, ">"},
+		Count:    count,
+		Block:    block,
+	}).Result()
+
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, fmt.Errorf("could not read from stream: %w", err)
+	}
+
+	for _, stream := range streams {
+		for _, m := range stream.Messages {
+			events = append(events, toEvent(m, 1))
+		}
+	}
+
+	return events, nil
+}
+
+// reclaim claims entries that were delivered (to any consumer) but
+// not acked within ClaimIdle, or nacked more than RetryDelay ago. It
+// runs at most once per the shorter of the two (but no more than once
+// a second), as entries can't become claimable any faster.
+func (s *Source) reclaim(ctx context.Context, count int64) ([]*source.Event, error) {
+	every := min(s.ClaimIdle, max(s.RetryDelay, time.Second))
+
+	s.mu.Lock()
+	if time.Since(s.lastReclaim) < every {
+		s.mu.Unlock()
+		return nil, nil
+	}
+	s.lastReclaim = time.Now()
+	s.mu.Unlock()
+
+	pending, err := s.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: s.Stream,
+		Group:  s.Group,
+		Idle:   s.ClaimIdle,
+		Start:  "-",
+		End:    "+",
+		Count:  count,
+	}).Result()
+
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("could not list pending entries: %w", err)
+	}
+
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(pending))
+	deliveries := map[string]int64{}
+	for _, p := range pending {
+		ids = append(ids, p.ID)
+		deliveries[p.ID] = p.RetryCount
+	}
+
+	// Only entries still idle for long enough are claimed, in
+	// case another consumer got to them first
+	claimed, err := s.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   s.Stream,
+		Group:    s.Group,
+		Consumer: s.Consumer,
+		MinIdle:  s.ClaimIdle,
+		Messages: ids,
+	}).Result()
+
+	if err != nil {
+		return nil, fmt.Errorf("could not claim pending entries: %w", err)
+	}
+
+	events := make([]*source.Event, 0, len(claimed))
+	for _, m := range claimed {
+		// Entries deleted from the stream can't be handled
+		if len(m.Values) == 0 {
+			s.client.XAck(ctx, s.Stream, s.Group, m.ID)
+			continue
+		}
+
+		// Claiming counts as another delivery
+		events = append(events, toEvent(m, int(deliveries[m.ID])+1))
+	}
+
+	if len(events) > 0 {
+		logging.GetLogger().Info("reclaimed stream entries", zap.String("stream", s.Stream), zap.Int("entries", len(events)))
+	}
+
+	return events, nil
+}
+
+func toEvent(m redis.XMessage, receiveCount int) *source.Event {
+	e := &source.Event{
+		Id:           m.ID,
+		Attributes:   map[string]string{},
+		ReceiveCount: receiveCount,
+		Handle:       m.ID,
+	}
+
+	for field, value := range m.Values {
+		v := fmt.Sprint(value)
+		if field == bodyField {
+			e.Body = v
+		} else {
+			e.Attributes[field] = v
+		}
+	}
+
+	return e
+}
@@ -0,0 +1,297 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/jobs"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/source"
+	"go.uber.org/zap"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// What to do about runs missed while lambdo was not running
+const (
+	MissedRunsSkip    = "skip"
+	MissedRunsRunOnce = "run_once"
+)
+
+// How long a failed run waits before it's tried again
+const retryDelay = 10 * time.Second
+
+// Names end up in Machine names, so they're kept simple
+var validName = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// scheduledRun is the Handle of a scheduled event, so
+// acking it can record when its schedule last ran
+type scheduledRun struct {
+	schedule string
+	at       time.Time
+}
+
+type schedule struct {
+	config.Schedule
+	cron    cron.Schedule
+	payload string
+}
+
+// Source is an EventSource that creates an event each
+// time one of the configured schedules is due. Runs are
+// queued in memory, and retried until they succeed or
+// were tried MaxReceiveCount times.
+type Source struct {
+	schedules []*schedule
+	queue     *source.MemoryQueue
+}
+
+// NewSource returns a schedule EventSource for the
+// configured schedules, which must all be valid
+func NewSource() (*Source, error) {
+	s := &Source{
+		queue: source.NewMemoryQueue(0, time.Duration(config.GetConfig().LeaseSeconds)*time.Second),
+	}
+
+	seen := map[string]bool{}
+	for _, c := range config.GetConfig().Schedules {
+		if !validName.MatchString(c.Name) {
+			return nil, fmt.Errorf("schedule name '%s' must only contain a-z, 0-9 and -", c.Name)
+		}
+
+		if seen[c.Name] {
+			return nil, fmt.Errorf("schedule name '%s' is used more than once", c.Name)
+		}
+		seen[c.Name] = true
+
+		if len(c.Image) == 0 {
+			return nil, fmt.Errorf("schedule %s has no image", c.Name)
+		}
+
+		if len(c.MissedRuns) == 0 {
+			c.MissedRuns = MissedRunsSkip
+		}
+
+		if c.MissedRuns != MissedRunsSkip && c.MissedRuns != MissedRunsRunOnce {
+			return nil, fmt.Errorf("schedule %s missed_runs must be '%s' or '%s'", c.Name, MissedRunsSkip, MissedRunsRunOnce)
+		}
+
+		parsed, err := cron.ParseStandard(c.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s has an invalid cron expression: %w", c.Name, err)
+		}
+
+		payload := []byte("{}")
+		if c.Payload != nil {
+			if payload, err = json.Marshal(c.Payload); err != nil {
+				return nil, fmt.Errorf("schedule %s payload can't be encoded as JSON: %w", c.Name, err)
+			}
+		}
+
+		s.schedules = append(s.schedules, &schedule{
+			Schedule: c,
+			cron:     parsed,
+			payload:  string(payload),
+		})
+	}
+
+	return s, nil
+}
+
+func (s *Source) Name() string {
+	return "schedule"
+}
+
+// Start runs every schedule in the background
+// until the context is cancelled
+func (s *Source) Start(ctx context.Context) {
+	if len(s.schedules) > 0 && jobs.GetStore() == nil {
+		logging.GetLogger().Warn("no job store is set, so schedules can't tell which runs were missed")
+	}
+
+	for _, sch := range s.schedules {
+		go s.run(ctx, sch)
+	}
+}
+
+// Receive waits for schedules to be due, and returns
+// as many of their events as one Machine can handle
+func (s *Source) Receive(ctx context.Context) ([]*source.Event, error) {
+	return s.queue.Receive(ctx, config.GetConfig().EventsPerMachine)
+}
+
+// Ack records that the runs happened, so they aren't run again as
+// missed runs. Runs are also acked once they're dead-lettered, which
+// their failed job tells apart.
+func (s *Source) Ack(ctx context.Context, events []*source.Event) error {
+	s.queue.Ack(events)
+
+	for _, e := range events {
+		r, ok := e.Handle.(*scheduledRun)
+		if !ok || !ran(e.Id) {
+			continue
+		}
+
+		if err := jobs.GetStore().SetLastRun(r.schedule, r.at); err != nil {
+			logging.GetLogger().Error("could not record the last run of a schedule", zap.String("schedule", r.schedule), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// Nack queues failed runs again after a delay, unless they were tried
+// MaxReceiveCount times already (if set). Those are dropped, and
+// the schedule runs again the next time it is due.
+func (s *Source) Nack(ctx context.Context, events []*source.Event) error {
+	maxReceives := config.GetConfig().MaxReceiveCount
+
+	retry := []*source.Event{}
+	dropped := []*source.Event{}
+	for _, e := range events {
+		if maxReceives > 0 && e.ReceiveCount >= maxReceives {
+			logging.GetLogger().Warn("scheduled run failed too many times, it will not be retried", zap.String("event-id", e.Id), zap.Int("receive-count", e.ReceiveCount))
+			dropped = append(dropped, e)
+			continue
+		}
+
+		retry = append(retry, e)
+	}
+
+	s.queue.Ack(dropped)
+	s.queue.Nack(retry, retryDelay)
+
+	return nil
+}
+
+// Extend keeps runs from being received again for another d
+func (s *Source) Extend(ctx context.Context, events []*source.Event, d time.Duration) error {
+	s.queue.Extend(events, d)
+	return nil
+}
+
+// run waits for a schedule to be due, over and over
+func (s *Source) run(ctx context.Context, sch *schedule) {
+	if sch.MissedRuns == MissedRunsRunOnce {
+		last, err := jobs.GetStore().LastRun(sch.Name)
+		if err != nil {
+			logging.GetLogger().Error("could not get the last run of a schedule", zap.String("schedule", sch.Name), zap.Error(err))
+		}
+
+		if missed := lastMissedRun(sch.cron, last, time.Now()); !missed.IsZero() {
+			logging.GetLogger().Info("running missed schedule", zap.String("schedule", sch.Name), zap.Time("run", missed))
+			s.dispatch(sch, missed)
+		}
+	}
+
+	next := sch.cron.Next(time.Now())
+	for {
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-timer.C:
+			s.dispatch(sch, next)
+			next = sch.cron.Next(time.Now())
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// dispatch queues the event of one run of a schedule, once it claimed
+// the run's job. The claim outlives the run's Machine (whose name is
+// free again once it's destroyed) and restarts of lambdo.
+func (s *Source) dispatch(sch *schedule, at time.Time) {
+	id := runId(sch.Name, at)
+
+	claimed, err := jobs.GetStore().Claim(&jobs.Job{
+		Id:         id,
+		Source:     s.Name(),
+		MessageIds: []string{id},
+		Image:      sch.Image,
+		Region:     sch.Region,
+	})
+
+	if err != nil {
+		logging.GetLogger().Error("could not claim a scheduled run, skipping it", zap.String("schedule", sch.Name), zap.String("job-id", id), zap.Error(err))
+		return
+	}
+
+	if !claimed {
+		logging.GetLogger().Debug("schedule already ran, skipping", zap.String("schedule", sch.Name), zap.String("job-id", id))
+		return
+	}
+
+	attributes := map[string]string{
+		"image":  sch.Image,
+		"job_id": id,
+
+		// Named Machines are unique, so a run is
+		// only ever started by one lambdo instance
+		"machine_name": id,
+	}
+
+	if len(sch.Size) > 0 {
+		attributes["size"] = sch.Size
+	}
+
+	if len(sch.Region) > 0 {
+		attributes["region"] = sch.Region
+	}
+
+	if len(sch.Command) > 0 {
+		cmd, _ := json.Marshal(sch.Command)
+		attributes["command"] = string(cmd)
+	}
+
+	// Unlimited queue, so this never fails
+	s.queue.Push(&source.Event{
+		Id:           id,
+		Body:         sch.payload,
+		Attributes:   attributes,
+		ReceiveCount: 1,
+		Handle:       &scheduledRun{schedule: sch.Name, at: at},
+	})
+}
+
+// ran is true unless the run's job failed (e.g. it was dead-lettered)
+// or never got a Machine. Without a job store, every run counts.
+func ran(id string) bool {
+	job, err := jobs.GetStore().Get(id)
+	if errors.Is(err, jobs.ErrDisabled) {
+		return true
+	}
+
+	if err != nil {
+		return false
+	}
+
+	return job.Status == jobs.StatusStarted || job.Status == jobs.StatusSucceeded || job.Status == jobs.StatusDuplicate
+}
+
+// runId identifies a run of a schedule, and is the
+// same for every lambdo instance running the schedule
+func runId(name string, run time.Time) string {
+	return "sched-" + name + "-" + strconv.FormatInt(run.Unix(), 10)
+}
+
+// lastMissedRun returns the most recent time the schedule was due
+// after the last run, up until now. The zero time means no run
+// was missed (or there's no last run to go by).
+func lastMissedRun(c cron.Schedule, last, now time.Time) time.Time {
+	if last.IsZero() {
+		return time.Time{}
+	}
+
+	missed := time.Time{}
+	for t := c.Next(last); !t.IsZero() && !t.After(now); t = c.Next(t) {
+		missed = t
+	}
+
+	return missed
+}
@@ -0,0 +1,11 @@
+package source
+
+import "context"
+
+// HealthChecker is implemented by event sources that can
+// report on their health, e.g. whether their queue is reachable
+type HealthChecker interface {
+	// Health returns details about the source (such as how many
+	// events are waiting), or an error if it is unhealthy
+	Health(ctx context.Context) (map[string]string, error)
+}
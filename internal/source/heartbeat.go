@@ -0,0 +1,46 @@
+package source
+
+import (
+	"context"
+	"github.com/superfly/lambdo/internal/logging"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Heartbeat extends the lease on the given events every interval
+// until the returned stop function is called or the context is
+// cancelled. Each extension pushes the lease out by extendBy.
+func Heartbeat(ctx context.Context, src EventSource, events []*Event, interval, extendBy time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				logging.GetLogger().Debug("extending event lease", zap.String("source", src.Name()), zap.Int("events", len(events)), zap.Duration("extend-by", extendBy))
+				if err := src.Extend(ctx, events, extendBy); err != nil {
+					logging.GetLogger().Error("could not extend event lease", zap.String("source", src.Name()), zap.Error(err))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Waiting on the goroutine means no extension can land after the
+	// caller has acked or nacked the events. Safe to call more than once.
+	return func() {
+		cancel()
+		<-done
+	}
+}
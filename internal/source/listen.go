@@ -0,0 +1,65 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/metrics"
+	"github.com/superfly/lambdo/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Listen receives events from the given source until the context
+// is cancelled, sending each non-empty batch to the batches channel
+func Listen(ctx context.Context, src EventSource, batches chan *Batch) error {
+	logging.GetLogger().Info("listening for events", zap.String("source", src.Name()))
+
+	for {
+		select {
+		case <-ctx.Done():
+			logging.GetLogger().Info("Shutdown: No longer listening for events", zap.String("source", src.Name()))
+			return nil
+		default:
+			receivedAt := time.Now()
+			events, err := src.Receive(ctx)
+
+			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					logging.GetLogger().Debug("Receive stopped: context cancelled", zap.String("source", src.Name()))
+					return nil
+				}
+
+				metrics.ReceiveErrors.WithLabelValues(src.Name()).Inc()
+				return fmt.Errorf("could not receive %s events: %w", src.Name(), err)
+			}
+
+			metrics.MessagesReceived.WithLabelValues(src.Name()).Add(float64(len(events)))
+
+			if len(events) > 0 {
+				// Empty polls aren't worth a trace, so this
+				// span is only started once we have events
+				_, span := tracing.Start(ctx, "source.Receive",
+					trace.WithTimestamp(receivedAt),
+					trace.WithNewRoot(),
+					trace.WithAttributes(
+						attribute.String("lambdo.source", src.Name()),
+						attribute.Int("lambdo.events", len(events)),
+					),
+				)
+				span.End()
+
+				// Fire and forget from this function's point of view
+				select {
+				case batches <- &Batch{Source: src, Events: events, SpanContext: span.SpanContext()}:
+				case <-ctx.Done():
+					logging.GetLogger().Info("Shutdown: dropping received events", zap.String("source", src.Name()), zap.Int("events", len(events)))
+					return nil
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemoryQueue is an in-memory queue of events, for sources that
+// are fed by lambdo itself rather than by a queue service. Its
+// events are lost when lambdo stops.
+//
+// Like a queue service, received events are in flight until they're
+// acked, and are received again if they aren't acked (or extended)
+// before their visibility timeout runs out.
+type MemoryQueue struct {
+	// Size is how many events can wait in the queue, 0 is unlimited
+	Size int
+
+	// Visibility is how long received events are in flight for
+	// before they're received again, 0 means they never are
+	Visibility time.Duration
+
+	mu       sync.Mutex
+	pending  []*Event
+	inFlight map[*Event]time.Time
+	ready    chan struct{}
+}
+
+// NewMemoryQueue returns an empty queue of the given size,
+// with the given visibility timeout for received events
+func NewMemoryQueue(size int, visibility time.Duration) *MemoryQueue {
+	return &MemoryQueue{
+		Size:       size,
+		Visibility: visibility,
+		inFlight:   map[*Event]time.Time{},
+		ready:      make(chan struct{}, 1),
+	}
+}
+
+// Push adds an event to the back of the queue, unless it is full
+func (q *MemoryQueue) Push(e *Event) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.Size > 0 && len(q.pending) >= q.Size {
+		return fmt.Errorf("queue is full (%d events)", q.Size)
+	}
+
+	q.pending = append(q.pending, e)
+	q.notify()
+
+	return nil
+}
+
+// Requeue puts events back at the front of the queue. They may take
+// the queue over its size, as they were in it already.
+func (q *MemoryQueue) Requeue(events []*Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.requeue(events)
+}
+
+// Ack forgets about received events, which are done with
+func (q *MemoryQueue) Ack(events []*Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, e := range events {
+		delete(q.inFlight, e)
+	}
+}
+
+// Nack puts received events back in the queue once the given
+// delay has passed, so failing events aren't retried in a tight loop
+func (q *MemoryQueue) Nack(events []*Event, delay time.Duration) {
+	q.Ack(events)
+
+	time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		for _, e := range events {
+			e.ReceiveCount++
+		}
+
+		q.requeue(events)
+	})
+}
+
+// Extend keeps received events in flight for another d from now
+func (q *MemoryQueue) Extend(events []*Event, d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	deadline := time.Now().Add(d)
+	for _, e := range events {
+		if _, ok := q.inFlight[e]; ok {
+			q.inFlight[e] = deadline
+		}
+	}
+}
+
+// Receive waits for events to be queued (or to be received
+// again), and returns up to limit of them
+func (q *MemoryQueue) Receive(ctx context.Context, limit int) ([]*Event, error) {
+	for {
+		events, next := q.take(limit)
+		if len(events) > 0 {
+			return events, nil
+		}
+
+		// Wake up when the next event in flight is due again
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if next > 0 {
+			timer = time.NewTimer(next)
+			expired = timer.C
+		}
+
+		select {
+		case <-q.ready:
+		case <-expired:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Len returns how many events are waiting
+func (q *MemoryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pending)
+}
+
+// InFlight returns how many events were received but not acked yet
+func (q *MemoryQueue) InFlight() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.inFlight)
+}
+
+// take returns up to limit events, and puts them in flight. If there
+// are none, it returns how long until an event in flight is due again.
+func (q *MemoryQueue) take(limit int) ([]*Event, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	q.expire(now)
+
+	n := min(limit, len(q.pending))
+	events := q.pending[:n:n]
+	q.pending = q.pending[n:]
+
+	if q.Visibility > 0 {
+		for _, e := range events {
+			q.inFlight[e] = now.Add(q.Visibility)
+		}
+	}
+
+	// More events are waiting for the next call
+	if len(q.pending) > 0 {
+		q.notify()
+	}
+
+	var next time.Duration
+	for _, deadline := range q.inFlight {
+		if until := deadline.Sub(now); next == 0 || until < next {
+			next = until
+		}
+	}
+
+	return events, next
+}
+
+// expire puts events whose visibility timeout ran out back
+// in the queue. Must be called with the lock held.
+func (q *MemoryQueue) expire(now time.Time) {
+	expired := []*Event{}
+	for e, deadline := range q.inFlight {
+		if !now.Before(deadline) {
+			e.ReceiveCount++
+			expired = append(expired, e)
+		}
+	}
+
+	if len(expired) > 0 {
+		q.requeue(expired)
+	}
+}
+
+// requeue puts events at the front of the queue, and
+// out of flight. Must be called with the lock held.
+func (q *MemoryQueue) requeue(events []*Event) {
+	for _, e := range events {
+		delete(q.inFlight, e)
+	}
+
+	q.pending = append(append([]*Event{}, events...), q.pending...)
+	q.notify()
+}
+
+// notify wakes up Receive, if it's waiting.
+// Must be called with the lock held.
+func (q *MemoryQueue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
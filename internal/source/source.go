@@ -0,0 +1,70 @@
+package source
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// Event is a single, source-agnostic event received
+// from an EventSource. The broker only ever reads the
+// Body and Attributes, everything else belongs to the
+// EventSource that created it.
+type Event struct {
+	// Id is a source-specific identifier (e.g. an SQS message ID),
+	// used mostly for logging
+	Id         string
+	Body       string
+	Attributes map[string]string
+
+	// ReceiveCount is how many times the source has delivered
+	// this event (including this time), or 0 if unknown
+	ReceiveCount int
+
+	// Handle is opaque to everything except the EventSource
+	// that created the Event, which uses it to ack/nack
+	// the Event (e.g. an SQS receipt handle)
+	Handle any
+}
+
+// Attribute returns the value of the given attribute
+func (e *Event) Attribute(attr string) (string, bool) {
+	v, ok := e.Attributes[attr]
+	return v, ok
+}
+
+// Batch is a group of Events received at the same time
+// from the same EventSource
+type Batch struct {
+	Source EventSource
+	Events []*Event
+
+	// SpanContext is the span the batch was received in,
+	// which everything done with its events is traced under
+	SpanContext trace.SpanContext
+}
+
+// EventSource is a queue (or queue-like thing) that
+// lambdo can receive events from
+type EventSource interface {
+	// Name is a short, human-readable name for the source, e.g. "sqs"
+	Name() string
+
+	// Receive blocks until a batch of events is available
+	// or the context is cancelled. It may return an empty
+	// slice if no events were found within the source's
+	// polling window.
+	Receive(ctx context.Context) ([]*Event, error)
+
+	// Ack marks events as successfully handled, so they are
+	// never delivered again
+	Ack(ctx context.Context, events []*Event) error
+
+	// Nack marks events as not handled, so they
+	// become available for redelivery
+	Nack(ctx context.Context, events []*Event) error
+
+	// Extend lengthens the lease on in-flight events so they are
+	// not redelivered while they are still being worked on
+	Extend(ctx context.Context, events []*Event, d time.Duration) error
+}
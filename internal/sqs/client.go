@@ -5,8 +5,10 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	cfg "github.com/superfly/lambdo/internal/config"
 	"github.com/superfly/lambdo/internal/logging"
 	"go.uber.org/zap"
+	"time"
 )
 
 var awsConfig aws.Config
@@ -21,3 +23,25 @@ func init() {
 		client = sqs.NewFromConfig(awsConfig)
 	}
 }
+
+// Source is an EventSource backed by an SQS queue
+type Source struct {
+	QueueUrl string
+
+	// RetryDelay is how long nacked messages stay
+	// invisible before they are redelivered
+	RetryDelay time.Duration
+}
+
+// NewSource returns an SQS EventSource for
+// the configured queue
+func NewSource() *Source {
+	return &Source{
+		QueueUrl:   cfg.GetConfig().SQSQueueUrl,
+		RetryDelay: time.Duration(cfg.GetConfig().SQSRetryDelaySeconds) * time.Second,
+	}
+}
+
+func (s *Source) Name() string {
+	return "sqs"
+}
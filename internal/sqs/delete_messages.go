@@ -5,13 +5,24 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
-	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/source"
 )
 
-func DeleteMessage(receiptHandler string) error {
-	_, err := client.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
-		QueueUrl:      aws.String(config.GetConfig().SQSQueueUrl),
-		ReceiptHandle: aws.String(receiptHandler),
+// Ack deletes the given events from the SQS queue
+func (s *Source) Ack(ctx context.Context, events []*source.Event) error {
+	for _, e := range events {
+		if err := s.deleteMessage(ctx, receiptHandle(e)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Source) deleteMessage(ctx context.Context, receiptHandle string) error {
+	_, err := client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(s.QueueUrl),
+		ReceiptHandle: aws.String(receiptHandle),
 	})
 
 	if err != nil {
@@ -20,3 +31,13 @@ func DeleteMessage(receiptHandler string) error {
 
 	return nil
 }
+
+// receiptHandle pulls the SQS receipt handle out
+// of an event created by this source
+func receiptHandle(e *source.Event) string {
+	if h, ok := e.Handle.(string); ok {
+		return h
+	}
+
+	return ""
+}
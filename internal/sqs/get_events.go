@@ -2,58 +2,60 @@ package sqs
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	cfg "github.com/superfly/lambdo/internal/config"
 	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/source"
+	"strconv"
 	"time"
 )
 
-type MessageHandler func([]types.Message)
-
-func Listen(ctx context.Context, messages chan []types.Message) error {
-	logging.GetLogger().Info("listening on SQS queue")
-
-GETMSGS:
-	for {
-		select {
-		case <-ctx.Done():
-			logging.GetLogger().Info("Shutdown: No longer listening for messages")
-			break GETMSGS
-		default:
-			logging.GetLogger().Debug("about to call sqs.ReceiveMessage")
-			response, sqsErr := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
-				QueueUrl:              aws.String(cfg.GetConfig().SQSQueueUrl),
-				MaxNumberOfMessages:   int32(cfg.GetConfig().EventsPerMachine),   // max of 10
-				WaitTimeSeconds:       int32(cfg.GetConfig().SQSLongPollSeconds), // long polling
-				VisibilityTimeout:     30,                                        // POC queue defaults to 30, we mirror that here
-				MessageAttributeNames: []string{"image", "size", "command"},
-			})
-
-			if sqsErr != nil {
-				if !errors.Is(sqsErr, context.Canceled) {
-					return fmt.Errorf("could not receive SQS messages: %w", sqsErr)
-				} else {
-					logging.GetLogger().Debug("ReceiveMessage stopped: context cancelled")
-					return nil
-				}
+// Receive gets the next batch of messages from the SQS queue
+func (s *Source) Receive(ctx context.Context) ([]*source.Event, error) {
+	logging.GetLogger().Debug("about to call sqs.ReceiveMessage")
+	response, err := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(s.QueueUrl),
+		MaxNumberOfMessages:   int32(cfg.GetConfig().EventsPerMachine), // max of 10
+		WaitTimeSeconds:       int32(cfg.GetConfig().PollSeconds),      // long polling
+		VisibilityTimeout:     int32(cfg.GetConfig().LeaseSeconds),     // extended by the broker's heartbeat
+		MessageAttributeNames: []string{"image", "size", "command", "region", "cpu_kind", "cpus", "memory_mb", "profile", "job_id", "machine_name"},
+		AttributeNames: []types.QueueAttributeName{
+			types.QueueAttributeName(types.MessageSystemAttributeNameApproximateReceiveCount),
+		},
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("could not receive SQS messages: %w", err)
+	}
 
+	events := make([]*source.Event, 0, len(response.Messages))
+	for _, m := range response.Messages {
+		attributes := map[string]string{}
+		for k, v := range m.MessageAttributes {
+			if v.StringValue != nil {
+				attributes[k] = *v.StringValue
 			}
+		}
 
-			if len(response.Messages) > 0 {
-				// Fire and forget from this function's point of view
-				messages <- response.Messages
-			}
+		// Not being able to parse this just means we don't know the count
+		receiveCount, _ := strconv.Atoi(m.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
 
-			// Add time between calls if we don't long poll
-			if cfg.GetConfig().SQSLongPollSeconds < 1 {
-				time.Sleep(time.Millisecond * 250)
-			}
-		}
+		events = append(events, &source.Event{
+			Id:           aws.ToString(m.MessageId),
+			Body:         aws.ToString(m.Body),
+			Attributes:   attributes,
+			ReceiveCount: receiveCount,
+			Handle:       aws.ToString(m.ReceiptHandle),
+		})
+	}
+
+	// Add time between calls if we don't long poll
+	if cfg.GetConfig().PollSeconds < 1 {
+		time.Sleep(time.Millisecond * 250)
 	}
 
-	return nil
+	return events, nil
 }
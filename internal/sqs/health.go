@@ -0,0 +1,40 @@
+package sqs
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Health checks the queue can be reached, and
+// returns roughly how many messages are in it
+func (s *Source) Health(ctx context.Context) (map[string]string, error) {
+	if client == nil {
+		return nil, fmt.Errorf("no sqs client, check the AWS configuration")
+	}
+
+	result, err := client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(s.QueueUrl),
+		AttributeNames: []types.QueueAttributeName{
+			types.QueueAttributeNameApproximateNumberOfMessages,
+			types.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+			types.QueueAttributeNameApproximateNumberOfMessagesDelayed,
+		},
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("could not get queue attributes: %w", err)
+	}
+
+	details := map[string]string{
+		"queue_url": s.QueueUrl,
+	}
+
+	for k, v := range result.Attributes {
+		details[k] = v
+	}
+
+	return details, nil
+}
@@ -0,0 +1,33 @@
+package sqs
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// SendMessage sends a message with string attributes
+// to the given SQS queue
+func SendMessage(ctx context.Context, queueUrl, body string, attributes map[string]string) error {
+	messageAttributes := map[string]types.MessageAttributeValue{}
+	for k, v := range attributes {
+		messageAttributes[k] = types.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(v),
+		}
+	}
+
+	_, err := client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(queueUrl),
+		MessageBody:       aws.String(body),
+		MessageAttributes: messageAttributes,
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not send message: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package sqs
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/superfly/lambdo/internal/source"
+	"time"
+)
+
+// Nack makes the given events visible in the SQS queue again once
+// RetryDelay has passed, so they are redelivered without failing
+// events being retried in a tight loop
+func (s *Source) Nack(ctx context.Context, events []*source.Event) error {
+	return s.changeVisibility(ctx, events, s.RetryDelay)
+}
+
+// Extend pushes out the visibility timeout of
+// the given (in-flight) events
+func (s *Source) Extend(ctx context.Context, events []*source.Event, d time.Duration) error {
+	return s.changeVisibility(ctx, events, d)
+}
+
+func (s *Source) changeVisibility(ctx context.Context, events []*source.Event, d time.Duration) error {
+	for _, e := range events {
+		_, err := client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(s.QueueUrl),
+			ReceiptHandle:     aws.String(receiptHandle(e)),
+			VisibilityTimeout: int32(d.Seconds()),
+		})
+
+		if err != nil {
+			return fmt.Errorf("could not change message visibility: %w", err)
+		}
+	}
+
+	return nil
+}
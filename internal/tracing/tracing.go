@@ -0,0 +1,94 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"github.com/superfly/lambdo/internal/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+)
+
+// Exporters spans can be sent to
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+const tracerName = "github.com/superfly/lambdo"
+
+var propagator = propagation.TraceContext{}
+
+// Configure sets up tracing based on the lambdo config. The returned
+// function flushes any remaining spans, and must be called on shutdown.
+// With no exporter, spans are still created (so trace context is still
+// passed on to Machines) but never sent anywhere.
+func Configure(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	var exporter sdktrace.SpanExporter
+	switch config.GetConfig().TracingExporter {
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		// Without an endpoint, the standard OTEL_EXPORTER_OTLP_* variables are used
+		opts := []otlptracehttp.Option{}
+		if endpoint := config.GetConfig().TracingEndpoint; len(endpoint) > 0 {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not create %s trace exporter: %w", config.GetConfig().TracingExporter, err)
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("lambdo"),
+			attribute.String("fly.app", config.GetConfig().FlyApp),
+			attribute.String("fly.region", config.GetConfig().FlyRegion),
+		)),
+	}
+
+	if exporter != nil {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span, as a child of any span in the context
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// End ends a span, marking it as failed if there was an error
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// Traceparent returns the W3C traceparent header value of the span
+// in the context, or an empty string if there is none
+func Traceparent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+
+	return carrier.Get("traceparent")
+}
@@ -0,0 +1,195 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/superfly/lambdo/internal/jobs"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/source"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Largest request body accepted, in bytes
+const maxBodyBytes = 1 << 20
+
+// headerPrefix marks request headers that are event
+// attributes, e.g. "Lambdo-Image" is the "image" attribute
+const headerPrefix = "Lambdo-"
+
+// envelope is an event and its attributes in one JSON object,
+// for producers that can't set headers
+type envelope struct {
+	Body       json.RawMessage   `json:"body"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+type accepted struct {
+	JobId   string `json:"job_id"`
+	EventId string `json:"event_id"`
+}
+
+// Start listens on the source's address and accepts events
+// in the background until the context is cancelled. Not
+// being able to listen is returned as an error.
+func (s *Source) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on webhook address: %w", err)
+	}
+
+	if len(s.Token) == 0 {
+		logging.GetLogger().Warn("no webhook token is set, anyone who can reach the webhook can run Machines")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.postEvent)
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		logging.GetLogger().Info("Shutdown: no longer accepting webhook events")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+		s.dropped()
+	}()
+
+	go func() {
+		logging.GetLogger().Info("webhook listening", zap.String("addr", listener.Addr().String()))
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.GetLogger().Error("webhook server error", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+// postEvent accepts an event, either as the request body with its
+// attributes as Lambdo-* headers, or as a JSON envelope (if there
+// are no such headers). The response has the event's job ID.
+func (s *Source) postEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if len(s.Token) > 0 {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+	}
+
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "request body is too large")
+		return
+	}
+
+	e, err := parseEvent(r.Header, raw)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.queue.Push(e); err != nil {
+		w.Header().Set("Retry-After", "5")
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	jobId := e.Attributes["job_id"]
+	if len(jobId) == 0 {
+		jobId = e.Attributes[jobs.AssignedIdAttribute]
+	}
+
+	logging.GetLogger().Debug("webhook event accepted", zap.String("event-id", e.Id), zap.String("job-id", jobId))
+
+	writeJSON(w, http.StatusAccepted, &accepted{
+		JobId:   jobId,
+		EventId: e.Id,
+	})
+}
+
+// parseEvent turns a request into an event. Events without a job_id
+// attribute are assigned a job ID to look them up by, but can still
+// share a Machine (and therefore a job) with other events.
+func parseEvent(header http.Header, raw []byte) (*source.Event, error) {
+	attributes := map[string]string{}
+	for name, values := range header {
+		if attr, ok := strings.CutPrefix(name, headerPrefix); ok && len(values) > 0 {
+			attributes[strings.ReplaceAll(strings.ToLower(attr), "-", "_")] = values[0]
+		}
+	}
+
+	body := raw
+	if len(attributes) == 0 {
+		env := &envelope{}
+		if err := json.Unmarshal(raw, env); err != nil {
+			return nil, fmt.Errorf("body must be a JSON envelope if no %s* headers are set: %w", headerPrefix, err)
+		}
+
+		body = env.Body
+		attributes = env.Attributes
+		if attributes == nil {
+			attributes = map[string]string{}
+		}
+	}
+
+	// Your code gets an array of every event's body
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("event body must be valid JSON")
+	}
+
+	if len(attributes["image"]) == 0 {
+		return nil, fmt.Errorf("event has no image")
+	}
+
+	if len(attributes["job_id"]) == 0 {
+		attributes[jobs.AssignedIdAttribute] = newId("job_")
+	}
+
+	return &source.Event{
+		Id:           newId("evt_"),
+		Body:         string(body),
+		Attributes:   attributes,
+		ReceiveCount: 1,
+	}, nil
+}
+
+func newId(prefix string) string {
+	b := make([]byte, 10)
+	rand.Read(b)
+
+	return prefix + hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.GetLogger().Error("could not write webhook response", zap.Error(err))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"context"
+	"github.com/superfly/lambdo/internal/config"
+	"github.com/superfly/lambdo/internal/logging"
+	"github.com/superfly/lambdo/internal/source"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+// How long nacked events wait before being received again
+const redeliveryDelay = 5 * time.Second
+
+// Source is an EventSource fed by HTTP requests. Events are
+// queued in memory, so any that weren't handled yet are
+// lost when lambdo stops. Events that aren't acked within the
+// visibility timeout are received again.
+type Source struct {
+	Addr  string
+	Token string
+
+	queue *source.MemoryQueue
+}
+
+// NewSource returns a webhook EventSource
+// listening on the configured address
+func NewSource() *Source {
+	return &Source{
+		Addr:  config.GetConfig().WebhookAddr,
+		Token: config.GetConfig().WebhookToken,
+		queue: source.NewMemoryQueue(
+			config.GetConfig().WebhookQueueSize,
+			time.Duration(config.GetConfig().LeaseSeconds)*time.Second,
+		),
+	}
+}
+
+func (s *Source) Name() string {
+	return "webhook"
+}
+
+// Receive waits for events to be posted, and returns
+// as many as one Machine can handle
+func (s *Source) Receive(ctx context.Context) ([]*source.Event, error) {
+	return s.queue.Receive(ctx, config.GetConfig().EventsPerMachine)
+}
+
+// Ack forgets about handled events, which
+// only ever lived in memory
+func (s *Source) Ack(ctx context.Context, events []*source.Event) error {
+	s.queue.Ack(events)
+	return nil
+}
+
+// Nack puts events back in the queue to be received again, after
+// a short delay so failing events aren't retried in a tight loop
+func (s *Source) Nack(ctx context.Context, events []*source.Event) error {
+	s.queue.Nack(events, redeliveryDelay)
+	return nil
+}
+
+// Extend keeps events from being received again for another d
+func (s *Source) Extend(ctx context.Context, events []*source.Event, d time.Duration) error {
+	s.queue.Extend(events, d)
+	return nil
+}
+
+// Health reports how many events are waiting
+func (s *Source) Health(ctx context.Context) (map[string]string, error) {
+	return map[string]string{
+		"addr":      s.Addr,
+		"pending":   strconv.Itoa(s.queue.Len()),
+		"in_flight": strconv.Itoa(s.queue.InFlight()),
+	}, nil
+}
+
+// dropped logs events that were never handled
+func (s *Source) dropped() {
+	if n := s.queue.Len() + s.queue.InFlight(); n > 0 {
+		logging.GetLogger().Warn("Shutdown: dropping webhook events that were not handled", zap.Int("events", n))
+	}
+}